@@ -1,41 +1,67 @@
 package restapi
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/xgfone/ship/v5"
+	"github.com/xmx/aegis-broker/application/business"
 	"github.com/xmx/aegis-broker/labelset"
+	"github.com/xmx/aegis-common/problem"
 	"github.com/xmx/aegis-control/linkhub"
 )
 
-type Pyroscope struct {
-	prx *httputil.ReverseProxy
-}
+// maxProfileSize 单个 profile 最大的报文大小。
+const maxProfileSize = 32 << 20
 
-func NewPyroscope() *Pyroscope {
-	pu, _ := url.Parse("https://pyroscope.example.com")
-	prx := &httputil.ReverseProxy{
-		Rewrite: func(pr *httputil.ProxyRequest) {
-			pr.SetURL(pu)
-		},
-	}
+func NewPyroscope(svc *business.Pyroscope) *Pyroscope {
 	return &Pyroscope{
-		prx: prx,
+		svc: svc,
+		cli: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+		},
 	}
 }
 
+type Pyroscope struct {
+	svc *business.Pyroscope
+	cli http.RoundTripper
+}
+
 func (prs *Pyroscope) RegisterRoute(r *ship.RouteGroupBuilder) error {
 	r.Route("/pyroscope/ingest").POST(prs.ingest)
 	return nil
 }
 
+// ingest 转发节点上报的 profile，支持两种格式：
+//
+//   - 旧版 /ingest?name=app{k=v}&format=folded|lines|trie|tree... 报文为文本或二进制
+//   - 新版 /ingest?name=app{k=v}&format=pprof 报文为 multipart/form-data（profile prev_profile sample_type_config）
+//
+// 两种格式的标签都在 name 参数中，broker 会在转发前补充节点的身份标签。
 func (prs *Pyroscope) ingest(c *ship.Context) error {
 	w, r := c.Response(), c.Request()
 	ctx := r.Context()
 	peer, _ := linkhub.FromContext(ctx)
 
 	quires := r.URL.Query()
+	if quires.Get("format") == "pprof" {
+		mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mt != "multipart/form-data" {
+			return ship.ErrBadRequest.Newf("pprof 格式的报文必须是 multipart/form-data")
+		}
+	}
+
 	labelSet, err := labelset.Parse(quires.Get("name"))
 	if err != nil {
 		return err
@@ -51,10 +77,84 @@ func (prs *Pyroscope) ingest(c *ship.Context) error {
 	labels["inet"] = inf.Inet
 	str := labelset.New(labels).LabelSet()
 	quires.Set("name", str)
+
+	up, err := prs.svc.Upstream(ctx)
+	if err != nil {
+		c.Warnf("获取 pyroscope 上游出错", "error", err)
+		return ship.ErrServiceUnavailable.Newf("%s", err.Error())
+	}
+
+	// 报文先完整读入内存：既可以限制大小，也能给上游一个确定的 Content-Length。
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxProfileSize))
+	if err != nil {
+		if mbe := new(http.MaxBytesError); errors.As(err, &mbe) {
+			return ship.ErrStatusRequestEntityTooLarge.Newf("profile 报文超过 %d 字节", mbe.Limit)
+		}
+		return err
+	}
+
 	r.URL.Path = "/ingest"
+	r.URL.RawPath = ""
 	r.URL.RawQuery = quires.Encode()
+	r.Body = io.NopCloser(bytes.NewReader(raw))
+	r.ContentLength = int64(len(raw))
+	r.Header.Set("Content-Length", strconv.Itoa(len(raw)))
 
-	prs.prx.ServeHTTP(w, r)
+	prx := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(up.URL)
+			pr.Out.Header.Del("Authorization") // 节点的认证信息不能透传到上游
+			for k, vs := range up.Header {
+				pr.Out.Header[k] = vs
+			}
+		},
+		Transport:      prs.cli,
+		ModifyResponse: prs.modifyResponse,
+		ErrorHandler:   prs.errorHandler,
+	}
+	prx.ServeHTTP(w, r)
 
 	return nil
 }
+
+// modifyResponse 上游认证失败时不能原样返回 401/403，否则节点会误以为自己没有通过 broker 的认证。
+func (*Pyroscope) modifyResponse(res *http.Response) error {
+	switch code := res.StatusCode; code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &upstreamError{status: code}
+	default:
+		return nil
+	}
+}
+
+func (*Pyroscope) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	pd := &problem.Details{
+		Host:     r.Host,
+		Instance: r.URL.Path,
+		Method:   r.Method,
+		Datetime: time.Now().UTC(),
+		Title:    "转发 pyroscope 失败",
+		Detail:   err.Error(),
+		Status:   http.StatusBadGateway,
+	}
+
+	var ue *upstreamError
+	switch {
+	case errors.As(err, &ue):
+		pd.Title = "pyroscope 上游认证失败"
+	case errors.Is(err, context.DeadlineExceeded):
+		pd.Status = http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return // 节点已经断开，无需响应。
+	}
+
+	_ = pd.JSON(w)
+}
+
+type upstreamError struct {
+	status int
+}
+
+func (e *upstreamError) Error() string {
+	return "pyroscope 上游响应状态码 " + strconv.Itoa(e.status)
+}
@@ -0,0 +1,136 @@
+package restapi
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xgfone/ship/v5"
+	"github.com/xmx/aegis-broker/application/agent/service"
+	"github.com/xmx/aegis-control/linkhub"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func NewRelease(svc *service.Release) *Release {
+	return &Release{svc: svc}
+}
+
+type Release struct {
+	svc *service.Release
+}
+
+func (rls *Release) RegisterRoute(r *ship.RouteGroupBuilder) error {
+	r.Route("/release/latest").GET(rls.latest)
+	r.Route("/release/download").GET(rls.download).HEAD(rls.download)
+	return nil
+}
+
+// latest 查询节点可升级的最新版本，没有更新的版本时响应 204。
+func (rls *Release) latest(c *ship.Context) error {
+	ctx := c.Request().Context()
+	peer, _ := linkhub.FromContext(ctx)
+
+	ret, err := rls.svc.Latest(ctx, peer)
+	if err != nil {
+		return err
+	}
+	if ret == nil {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	return c.JSON(http.StatusOK, ret)
+}
+
+// download 下载升级包，支持 Range 断点续传与 If-None-Match 等条件请求。
+//
+// ETag 等响应头只需要升级包的元数据，HEAD 请求与命中缓存的条件请求不经过下载调度器，
+// 也不会从 GridFS 拉取文件，只有真正传输文件内容时才申请下载名额。
+//
+//goland:noinspection GoUnhandledErrorResult
+func (rls *Release) download(c *ship.Context) error {
+	id, err := bson.ObjectIDFromHex(c.Query("id"))
+	if err != nil {
+		return ship.ErrBadRequest.Newf("升级包 ID 格式错误")
+	}
+
+	w, r := c.Response(), c.Request()
+	ctx := r.Context()
+	peer, _ := linkhub.FromContext(ctx)
+	release, err := rls.svc.Find(ctx, id, peer)
+	if err != nil {
+		return err
+	}
+
+	chk := release.Checksum
+	etag := chk.SHA256
+	if etag == "" {
+		etag = release.ID.Hex()
+	}
+	etag = strconv.Quote(etag)
+	header := w.Header()
+	header.Set("ETag", etag)
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Disposition", "attachment; filename="+strconv.Quote(release.Filename))
+	for k, v := range chk.Map() {
+		if v != "" {
+			header.Set("X-Checksum-"+k, v)
+		}
+	}
+	if !release.CreatedAt.IsZero() {
+		header.Set("Last-Modified", release.CreatedAt.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(r, etag, release.CreatedAt) {
+		header.Del("Content-Type")
+		return c.NoContent(http.StatusNotModified)
+	}
+	if r.Method == http.MethodHead {
+		header.Set("Accept-Ranges", "bytes")
+		if release.Length > 0 {
+			header.Set("Content-Length", strconv.FormatInt(release.Length, 10))
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	f, err := rls.svc.Open(ctx, release)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, release.Filename, release.CreatedAt, f)
+
+	return nil
+}
+
+// notModified 条件请求（GET 或 HEAD）是否命中节点的缓存，规则与 http.ServeContent 一致：
+// 有 If-None-Match 时只比较 ETag（弱比较），否则比较 If-Modified-Since。
+func notModified(r *http.Request, etag string, modtime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for tag := range strings.SplitSeq(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || modtime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+
+	// HTTP 时间只精确到秒。
+	return !modtime.Truncate(time.Second).After(t)
+}
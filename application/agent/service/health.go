@@ -5,6 +5,8 @@ import (
 	"log/slog"
 	"time"
 
+	"github.com/xmx/aegis-broker/application/business"
+	"github.com/xmx/aegis-broker/channel/serverd"
 	"github.com/xmx/aegis-control/datalayer/repository"
 	"github.com/xmx/aegis-control/linkhub"
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -12,25 +14,35 @@ import (
 
 type Health struct {
 	repo repository.All
+	tun  serverd.Server
+	boot *business.BrokerConfig
 	log  *slog.Logger
 }
 
-func NewHealth(repo repository.All, log *slog.Logger) *Health {
+func NewHealth(repo repository.All, tun serverd.Server, boot *business.BrokerConfig, log *slog.Logger) *Health {
 	return &Health{
 		repo: repo,
+		tun:  tun,
+		boot: boot,
 		log:  log,
 	}
 }
 
+// Ping 记录节点心跳。
+//
+// 心跳默认只记录在内存中，由定时任务批量写入数据库；开启 write_through 时立即写入数据库。
 func (hlt *Health) Ping(ctx context.Context, peer linkhub.Peer) error {
 	now := time.Now()
 	id := peer.ID()
-	filter := bson.D{{"_id", id}, {"status", true}}
-	update := bson.M{"$set": bson.M{"tunnel_stat.keepalive_at": now}}
-
-	repo := hlt.repo.Agent()
-	if _, err := repo.UpdateOne(ctx, filter, update); err != nil {
-		return err
+	hlt.tun.Keepalive(id, now)
+	if boot, _ := hlt.boot.Load(ctx); boot != nil && boot.Keepalive.WriteThrough {
+		filter := bson.D{{"_id", id}, {"status", true}}
+		update := bson.M{"$set": bson.M{"tunnel_stat.keepalive_at": now}}
+
+		repo := hlt.repo.Agent()
+		if _, err := repo.UpdateOne(ctx, filter, update); err != nil {
+			return err
+		}
 	}
 
 	info := peer.Info()
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/xgfone/ship/v5"
+	"github.com/xmx/aegis-broker/application/business"
+	"github.com/xmx/aegis-control/datalayer/model"
+	"github.com/xmx/aegis-control/datalayer/repository"
+	"github.com/xmx/aegis-control/linkhub"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func NewRelease(repo repository.All, cache *business.Artifact, sched *business.DownloadScheduler, log *slog.Logger) *Release {
+	return &Release{
+		repo:  repo,
+		cache: cache,
+		sched: sched,
+		log:   log,
+	}
+}
+
+type Release struct {
+	repo  repository.All
+	cache *business.Artifact
+	sched *business.DownloadScheduler
+	log   *slog.Logger
+}
+
+// Latest 查询适用于该节点的最新版本，没有比节点当前更新的版本时返回 nil。
+func (rls *Release) Latest(ctx context.Context, peer linkhub.Peer) (*model.AgentRelease, error) {
+	info := peer.Info()
+	num := model.ParseSemver(info.Semver)
+	filter := bson.M{"goos": info.Goos, "goarch": info.Goarch, "version": bson.M{"$gt": num}}
+	opt := options.FindOne().SetSort(bson.M{"version": -1})
+
+	repo := rls.repo.AgentRelease()
+	ret, err := repo.FindOne(ctx, filter, opt)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+
+	return ret, err
+}
+
+// Find 查询节点要下载的升级包，升级包必须与节点的系统架构一致。
+func (rls *Release) Find(ctx context.Context, id bson.ObjectID, peer linkhub.Peer) (*model.AgentRelease, error) {
+	repo := rls.repo.AgentRelease()
+	release, err := repo.FindByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ship.ErrNotFound.Newf("升级包不存在")
+		}
+		return nil, err
+	}
+
+	info := peer.Info()
+	if release.Goos != info.Goos || release.Goarch != info.Goarch {
+		return nil, ship.ErrBadRequest.Newf("升级包与节点的系统架构不匹配")
+	}
+
+	return release, nil
+}
+
+// Open 打开升级包，文件由调用方关闭。
+//
+// 打开前需要向下载调度器申请名额，返回的文件读取时会被限速，关闭文件时归还名额。
+// 只有真正需要传输文件内容时才调用，HEAD 与条件请求命中缓存时不应占用名额。
+func (rls *Release) Open(ctx context.Context, release *model.AgentRelease) (io.ReadSeekCloser, error) {
+	done, err := rls.sched.Acquire(ctx)
+	if err != nil {
+		if errors.Is(err, business.ErrDownloadBusy) {
+			return nil, ship.ErrTooManyRequests.Newf("%s", err.Error())
+		}
+		return nil, err
+	}
+
+	f, err := rls.cache.Open(ctx, release)
+	if err != nil {
+		done()
+		attrs := []any{"release_id", release.ID, "error", err}
+		rls.log.Warn("打开节点升级包缓存出错", attrs...)
+		return nil, err
+	}
+	rs := rls.sched.Reader(ctx, f)
+
+	return &scheduledFile{ReadSeeker: rs, file: f, done: done}, nil
+}
+
+// scheduledFile 限速读取的升级包文件，关闭时归还下载名额。
+type scheduledFile struct {
+	io.ReadSeeker
+	file io.Closer
+	done func()
+}
+
+func (sf *scheduledFile) Close() error {
+	err := sf.file.Close()
+	sf.done()
+
+	return err
+}
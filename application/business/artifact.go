@@ -0,0 +1,270 @@
+package business
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xmx/aegis-control/datalayer/model"
+	"github.com/xmx/aegis-control/datalayer/repository"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// NewArtifact 节点升级包的本地磁盘缓存。
+//
+// 大量节点同时升级时，同一个升级包只会从 GridFS 拉取一次，落地到本地磁盘后由各个请求共享。
+// maxSize 为缓存目录的最大字节数，超出后按最近访问时间淘汰，小于等于 0 代表不限制。
+//
+// 进程启动前就存在的缓存文件，第一次使用时会校验哈希，校验不通过则重新拉取。
+func NewArtifact(repo repository.All, dir string, maxSize int64, log *slog.Logger) *Artifact {
+	return &Artifact{
+		repo:     repo,
+		dir:      dir,
+		maxSize:  maxSize,
+		log:      log,
+		calls:    make(map[bson.ObjectID]*artifactCall, 8),
+		verified: make(map[bson.ObjectID]struct{}, 8),
+	}
+}
+
+type Artifact struct {
+	repo     repository.All
+	dir      string
+	maxSize  int64
+	log      *slog.Logger
+	mutex    sync.Mutex
+	calls    map[bson.ObjectID]*artifactCall // 正在从 GridFS 拉取（或校验）的文件
+	verified map[bson.ObjectID]struct{}      // 本进程内已经校验过哈希的缓存文件
+}
+
+type artifactCall struct {
+	done chan struct{}
+	err  error
+}
+
+// Open 打开升级包的本地缓存，缓存不存在或校验不通过时从 GridFS 拉取，并发请求同一个文件只会拉取一次。
+func (a *Artifact) Open(ctx context.Context, release *model.AgentRelease) (*os.File, error) {
+	name := a.filename(release.ID)
+	if a.isVerified(release.ID) {
+		if f, err := a.openCached(name, release); err == nil {
+			return f, nil
+		}
+	}
+
+	if err := a.fetch(ctx, release); err != nil {
+		return nil, err
+	}
+
+	return a.openCached(name, release)
+}
+
+func (a *Artifact) openCached(name string, release *model.AgentRelease) (*os.File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil || (release.Length > 0 && stat.Size() != release.Length) {
+		_ = f.Close()
+		_ = os.Remove(name)
+		return nil, os.ErrNotExist
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(name, now, now) // 刷新访问时间，淘汰时参考。
+
+	return f, nil
+}
+
+func (a *Artifact) fetch(ctx context.Context, release *model.AgentRelease) error {
+	id := release.ID
+	a.mutex.Lock()
+	call, running := a.calls[id]
+	if !running {
+		call = &artifactCall{done: make(chan struct{})}
+		a.calls[id] = call
+	}
+	a.mutex.Unlock()
+
+	if running {
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// 拉取文件不能因为某一个请求结束而中断，其它请求还在等待结果。
+	fctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Minute)
+	if call.err = a.verify(release); call.err != nil {
+		call.err = a.download(fctx, release)
+	}
+	cancel()
+
+	a.mutex.Lock()
+	delete(a.calls, id)
+	if call.err == nil {
+		a.verified[id] = struct{}{}
+	}
+	a.mutex.Unlock()
+	close(call.done)
+
+	if call.err == nil {
+		a.evict(a.filename(id))
+	}
+
+	return call.err
+}
+
+//goland:noinspection GoUnhandledErrorResult
+func (a *Artifact) download(ctx context.Context, release *model.AgentRelease) error {
+	attrs := []any{"release_id", release.ID, "filename", release.Filename, "semver", release.Semver}
+	a.log.Info("开始缓存节点升级包", attrs...)
+
+	if err := os.MkdirAll(a.dir, 0o755); err != nil {
+		return err
+	}
+	stm, err := a.repo.AgentRelease().OpenFile(ctx, release.FileID)
+	if err != nil {
+		attrs = append(attrs, "error", err)
+		a.log.Warn("打开节点升级包出错", attrs...)
+		return err
+	}
+	defer stm.Close()
+
+	tmp, err := os.CreateTemp(a.dir, ".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+	defer tmp.Close()
+
+	hw := model.NewHashWriter()
+	size, err := io.Copy(io.MultiWriter(tmp, hw), stm)
+	if err != nil {
+		attrs = append(attrs, "error", err)
+		a.log.Warn("缓存节点升级包出错", attrs...)
+		return err
+	}
+	if err = checkArtifact(release, size, hw.Sum()); err != nil {
+		attrs = append(attrs, "error", err)
+		a.log.Warn("缓存节点升级包校验不通过", attrs...)
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, a.filename(release.ID)); err != nil {
+		return err
+	}
+	attrs = append(attrs, "size", size)
+	a.log.Info("节点升级包缓存完毕", attrs...)
+
+	return nil
+}
+
+// verify 校验已经存在的缓存文件，校验不通过时删除该文件。
+//
+//goland:noinspection GoUnhandledErrorResult
+func (a *Artifact) verify(release *model.AgentRelease) error {
+	name := a.filename(release.ID)
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hw := model.NewHashWriter()
+	size, err := io.Copy(hw, f)
+	if err == nil {
+		err = checkArtifact(release, size, hw.Sum())
+	}
+	if err != nil {
+		a.log.Warn("节点升级包缓存校验不通过，重新拉取", "release_id", release.ID, "name", name, "error", err)
+		_ = os.Remove(name)
+	}
+
+	return err
+}
+
+func (a *Artifact) isVerified(id bson.ObjectID) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	_, ok := a.verified[id]
+
+	return ok
+}
+
+// checkArtifact 校验升级包的大小与哈希。
+func checkArtifact(release *model.AgentRelease, size int64, sum model.Checksum) error {
+	if release.Length > 0 && size != release.Length {
+		return errors.New("节点升级包大小不一致")
+	}
+	got := sum.Map()
+	for k, v := range release.Checksum.Map() {
+		if v != "" && !strings.EqualFold(v, got[k]) {
+			return errors.New("节点升级包 " + k + " 校验不通过")
+		}
+	}
+
+	return nil
+}
+
+// evict 缓存超出容量时按照访问时间从旧到新淘汰，keep 为刚刚缓存的文件不会被淘汰。
+//
+// 已经被打开的文件在 unix 下删除后仍可继续读取。
+func (a *Artifact) evict(keep string) {
+	if a.maxSize <= 0 {
+		return
+	}
+
+	type entry struct {
+		name string
+		size int64
+		time time.Time
+	}
+	var total int64
+	var entries []entry
+	_ = filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		if info, _ := d.Info(); info != nil {
+			total += info.Size()
+			entries = append(entries, entry{name: path, size: info.Size(), time: info.ModTime()})
+		}
+		return nil
+	})
+	if total <= a.maxSize {
+		return
+	}
+
+	slices.SortFunc(entries, func(x, y entry) int { return x.time.Compare(y.time) })
+	for _, ent := range entries {
+		if total <= a.maxSize {
+			break
+		}
+		if ent.name == keep {
+			continue
+		}
+		if err := os.Remove(ent.name); err == nil {
+			total -= ent.size
+			a.log.Info("淘汰节点升级包缓存", "name", ent.name, "size", ent.size)
+		}
+	}
+}
+
+func (a *Artifact) filename(id bson.ObjectID) string {
+	return filepath.Join(a.dir, id.Hex())
+}
@@ -0,0 +1,268 @@
+package business
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/xmx/aegis-broker/config"
+	"github.com/xmx/aegis-common/muxlink/muxconn"
+	"github.com/xmx/aegis-control/datalayer/repository"
+	"github.com/xmx/aegis-control/linkhub"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"golang.org/x/time/rate"
+)
+
+// NewBandwidth 通道带宽策略。
+//
+// 单个节点的带宽上限保存在 agent 文档的 bandwidth 字段（KiB/s），没有设置时使用
+// broker 配置 config.bandwidth.agent 的默认值；broker 连接中心端的通道带宽上限为
+// config.bandwidth.broker。策略均保存在数据库中，节点或 broker 断线重连后依然生效。
+func NewBandwidth(repo repository.All, boot *BrokerConfig, hub linkhub.Huber, mux muxconn.Muxer, log *slog.Logger) *Bandwidth {
+	return &Bandwidth{
+		repo: repo,
+		boot: boot,
+		hub:  hub,
+		mux:  mux,
+		log:  log,
+	}
+}
+
+type Bandwidth struct {
+	repo repository.All
+	boot *BrokerConfig
+	hub  linkhub.Huber
+	mux  muxconn.Muxer
+	log  *slog.Logger
+}
+
+// BrokerBandwidth broker 的带宽策略，单位均为 KiB/s，0 代表不限制。
+type BrokerBandwidth struct {
+	Broker  int64 `json:"broker"`  // 连接中心端的通道带宽上限
+	Agent   int64 `json:"agent"`   // 节点通道默认的带宽上限
+	Current int64 `json:"current"` // 连接中心端的通道当前实际的限速
+}
+
+// AgentBandwidth 节点的带宽策略，单位均为 KiB/s，0 代表不限制。
+type AgentBandwidth struct {
+	ID      bson.ObjectID `json:"id"`
+	Limit   int64         `json:"limit"`   // 生效的带宽上限
+	Custom  *int64        `json:"custom"`  // 节点单独设置的带宽上限，为空代表使用默认值
+	Online  bool          `json:"online"`  // 是否在当前 broker 上在线
+	Current int64         `json:"current"` // 通道当前实际的限速，不在线时为 0
+}
+
+// Bandwidth 查询节点通道的带宽上限，节点认证通过时调用。
+func (bw *Bandwidth) Bandwidth(ctx context.Context, agentID bson.ObjectID) (rate.Limit, error) {
+	boot, err := bw.boot.Load(ctx)
+	if err != nil {
+		return rate.Inf, err
+	}
+	customs, err := bw.customs(ctx, []bson.ObjectID{agentID})
+	if err != nil {
+		return rate.Inf, err
+	}
+	limit := effectiveLimit(customs[agentID], boot.Bandwidth.Agent)
+
+	return kibToLimit(limit), nil
+}
+
+// Broker 查询 broker 的带宽策略。
+func (bw *Bandwidth) Broker(ctx context.Context) (*BrokerBandwidth, error) {
+	boot, err := bw.boot.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret := &BrokerBandwidth{
+		Broker:  boot.Bandwidth.Broker,
+		Agent:   boot.Bandwidth.Agent,
+		Current: limitToKiB(bw.mux.Limit()),
+	}
+
+	return ret, nil
+}
+
+// SetBroker 修改 broker 的带宽策略并保存到数据库，通过重新加载配置立即生效。
+func (bw *Bandwidth) SetBroker(ctx context.Context, cfg config.BootBandwidth) error {
+	update := bson.M{"$set": bson.M{"config.bandwidth": cfg}}
+	repo := bw.repo.Broker()
+	if _, err := repo.UpdateByID(ctx, bw.boot.id, update); err != nil {
+		return err
+	}
+	_, err := bw.boot.Reload(ctx)
+
+	return err
+}
+
+// Agents 查询当前 broker 上所有在线节点的带宽策略。
+func (bw *Bandwidth) Agents(ctx context.Context) ([]*AgentBandwidth, error) {
+	boot, err := bw.boot.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := bw.hub.Peers()
+	ids := make([]bson.ObjectID, 0, len(peers))
+	for _, peer := range peers {
+		ids = append(ids, peer.ID())
+	}
+	customs, err := bw.customs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	rets := make([]*AgentBandwidth, 0, len(peers))
+	for _, peer := range peers {
+		id := peer.ID()
+		custom := customs[id]
+		rets = append(rets, &AgentBandwidth{
+			ID:      id,
+			Limit:   effectiveLimit(custom, boot.Bandwidth.Agent),
+			Custom:  custom,
+			Online:  true,
+			Current: limitToKiB(peer.Muxer().Limit()),
+		})
+	}
+
+	return rets, nil
+}
+
+// Agent 查询节点的带宽策略，节点不存在时返回 mongo.ErrNoDocuments。
+func (bw *Bandwidth) Agent(ctx context.Context, id bson.ObjectID) (*AgentBandwidth, error) {
+	boot, err := bw.boot.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		Bandwidth *int64 `bson:"bandwidth"`
+	}
+	opt := options.FindOne().SetProjection(bson.M{"bandwidth": 1})
+	coll := bw.repo.Agent().Collection()
+	if err = coll.FindOne(ctx, bson.M{"_id": id}, opt).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	ret := &AgentBandwidth{
+		ID:     id,
+		Limit:  effectiveLimit(doc.Bandwidth, boot.Bandwidth.Agent),
+		Custom: doc.Bandwidth,
+	}
+	if peer := bw.hub.GetID(id); peer != nil {
+		ret.Online = true
+		ret.Current = limitToKiB(peer.Muxer().Limit())
+	}
+
+	return ret, nil
+}
+
+// SetAgent 修改节点的带宽上限并保存到数据库，limit 为空代表恢复使用默认值。
+// 节点在当前 broker 上在线时立即生效，节点不存在时返回 mongo.ErrNoDocuments。
+func (bw *Bandwidth) SetAgent(ctx context.Context, id bson.ObjectID, limit *int64) (*AgentBandwidth, error) {
+	update := bson.M{"$unset": bson.M{"bandwidth": ""}}
+	if limit != nil {
+		update = bson.M{"$set": bson.M{"bandwidth": *limit}}
+	}
+	repo := bw.repo.Agent()
+	ret, err := repo.UpdateByID(ctx, id, update)
+	if err != nil {
+		return nil, err
+	} else if ret.MatchedCount == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	boot, err := bw.boot.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if peer := bw.hub.GetID(id); peer != nil {
+		eff := effectiveLimit(limit, boot.Bandwidth.Agent)
+		peer.Muxer().SetLimit(kibToLimit(eff))
+		bw.log.Info("修改节点通道带宽上限", "agent_id", id, "limit", eff)
+	}
+
+	return bw.Agent(ctx, id)
+}
+
+// Apply 使带宽策略生效：broker 连接中心端的通道，以及没有单独设置带宽上限的在线节点。
+//
+// 用于启动时与配置热加载，不会读取当前配置，所以可以在配置变更回调中调用。
+func (bw *Bandwidth) Apply(ctx context.Context, cfg config.BootBandwidth) {
+	bw.mux.SetLimit(kibToLimit(cfg.Broker))
+
+	peers := bw.hub.Peers()
+	if len(peers) == 0 {
+		return
+	}
+	ids := make([]bson.ObjectID, 0, len(peers))
+	for _, peer := range peers {
+		ids = append(ids, peer.ID())
+	}
+	customs, err := bw.customs(ctx, ids)
+	if err != nil {
+		bw.log.Warn("查询节点带宽策略出错", "error", err)
+		return
+	}
+	for _, peer := range peers {
+		if _, exists := customs[peer.ID()]; !exists {
+			peer.Muxer().SetLimit(kibToLimit(cfg.Agent))
+		}
+	}
+	bw.log.Info("通道带宽策略已生效", "broker", cfg.Broker, "agent", cfg.Agent)
+}
+
+// customs 查询节点单独设置的带宽上限，没有单独设置的节点不在结果中。
+//
+//goland:noinspection GoUnhandledErrorResult
+func (bw *Bandwidth) customs(ctx context.Context, ids []bson.ObjectID) (map[bson.ObjectID]*int64, error) {
+	filter := bson.M{"_id": bson.M{"$in": ids}, "bandwidth": bson.M{"$exists": true}}
+	opt := options.Find().SetProjection(bson.M{"bandwidth": 1})
+	coll := bw.repo.Agent().Collection()
+	cur, err := coll.Find(ctx, filter, opt)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var docs []struct {
+		ID        bson.ObjectID `bson:"_id"`
+		Bandwidth int64         `bson:"bandwidth"`
+	}
+	if err = cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	ret := make(map[bson.ObjectID]*int64, len(docs))
+	for _, doc := range docs {
+		ret[doc.ID] = &doc.Bandwidth
+	}
+
+	return ret, nil
+}
+
+func effectiveLimit(custom *int64, def int64) int64 {
+	if custom != nil {
+		return *custom
+	}
+
+	return def
+}
+
+// kibToLimit KiB/s 转为限速器的字节/秒，小于等于 0 代表不限制。
+func kibToLimit(kib int64) rate.Limit {
+	if kib <= 0 {
+		return rate.Inf
+	}
+
+	return rate.Limit(kib * 1024)
+}
+
+// limitToKiB 限速器的字节/秒转为 KiB/s，不限制时返回 0。
+func limitToKiB(limit rate.Limit) int64 {
+	if limit == rate.Inf || limit <= 0 {
+		return 0
+	}
+
+	return int64(limit) / 1024
+}
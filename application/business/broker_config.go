@@ -0,0 +1,171 @@
+package business
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/xmx/aegis-broker/config"
+	"github.com/xmx/aegis-control/datalayer/repository"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// BrokerConfigHook 配置变更回调。
+type BrokerConfigHook func(ctx context.Context, old, cur *config.Boot)
+
+func NewBrokerConfig(repo repository.All, id bson.ObjectID, log *slog.Logger) *BrokerConfig {
+	return &BrokerConfig{
+		repo: repo,
+		id:   id,
+		log:  log,
+	}
+}
+
+// BrokerConfig 当前 broker 的运行配置（数据库 broker 文档的 config 字段）。
+//
+// 配置变化时（数据库 change stream 通知或手动触发 Reload）会依次调用注册的回调，
+// 由回调方完成日志、监听地址等配置的热加载。
+type BrokerConfig struct {
+	repo  repository.All
+	id    bson.ObjectID
+	log   *slog.Logger
+	mutex sync.Mutex
+	cur   *config.Boot
+	hooks []BrokerConfigHook
+}
+
+// Load 返回当前生效的配置，首次调用时从数据库读取。
+func (bc *BrokerConfig) Load(ctx context.Context) (*config.Boot, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if cur := bc.cur; cur != nil {
+		return cur, nil
+	}
+
+	cur, err := bc.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bc.cur = cur
+
+	return cur, nil
+}
+
+// OnChange 注册配置变更回调。
+//
+// 回调执行期间持有锁，回调内不可再调用 Load 和 Reload。
+func (bc *BrokerConfig) OnChange(hook BrokerConfigHook) {
+	bc.mutex.Lock()
+	bc.hooks = append(bc.hooks, hook)
+	bc.mutex.Unlock()
+}
+
+// Reload 从数据库重新读取配置，如果配置有变化则调用变更回调。
+func (bc *BrokerConfig) Reload(ctx context.Context) (bool, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	cur, err := bc.read(ctx)
+	if err != nil {
+		bc.log.Warn("重新加载 broker 配置出错", "error", err)
+		return false, err
+	}
+
+	old := bc.cur
+	if reflect.DeepEqual(old, cur) {
+		bc.log.Debug("broker 配置没有变化")
+		return false, nil
+	}
+	bc.cur = cur
+	bc.log.Info("broker 配置发生了变化，开始热加载")
+
+	for _, hook := range bc.hooks {
+		hook(ctx, old, cur)
+	}
+
+	return true, nil
+}
+
+// Watch 通过 change stream 监听数据库中当前 broker 文档的变化，直至 ctx 取消。
+//
+// change stream 要求 MongoDB 以副本集或分片集群方式部署，如果不支持，
+// 只能通过接口手动触发 Reload。
+func (bc *BrokerConfig) Watch(ctx context.Context) {
+	const retry = 30 * time.Second
+	for {
+		err := bc.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		bc.log.Warn("监听 broker 配置变化出错，稍后重试", "error", err, "sleep", retry)
+
+		timer := time.NewTimer(retry)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+//goland:noinspection GoUnhandledErrorResult
+func (bc *BrokerConfig) watch(ctx context.Context) error {
+	// broker 文档还会被租约续期、流量统计等频繁修改，只关心 config 字段的变化。
+	updated := bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$updateDescription.updatedFields", bson.M{}}}}
+	removed := bson.M{"$ifNull": bson.A{"$updateDescription.removedFields", bson.A{}}}
+	fields := bson.M{"$concatArrays": bson.A{
+		bson.M{"$map": bson.M{"input": updated, "in": "$$this.k"}},
+		removed,
+	}}
+	isConfig := bson.M{"$or": bson.A{
+		bson.M{"$eq": bson.A{"$$this", "config"}},
+		bson.M{"$eq": bson.A{bson.M{"$substrCP": bson.A{"$$this", 0, 7}}, "config."}},
+	}}
+	match := bson.M{
+		"documentKey._id": bc.id,
+		"$or": bson.A{
+			bson.M{"operationType": "replace"},
+			bson.M{
+				"operationType": "update",
+				"$expr": bson.M{"$anyElementTrue": bson.A{
+					bson.M{"$map": bson.M{"input": fields, "in": isConfig}},
+				}},
+			},
+		},
+	}
+	pipe := mongo.Pipeline{{{Key: "$match", Value: match}}}
+
+	repo := bc.repo.Broker()
+	stm, err := repo.Watch(ctx, pipe)
+	if err != nil {
+		return err
+	}
+	defer stm.Close(context.Background())
+
+	bc.log.Info("开始监听 broker 配置变化")
+	for stm.Next(ctx) {
+		rctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		_, _ = bc.Reload(rctx)
+		cancel()
+	}
+
+	return stm.Err()
+}
+
+func (bc *BrokerConfig) read(ctx context.Context) (*config.Boot, error) {
+	var doc struct {
+		Config config.Boot `bson:"config"`
+	}
+
+	coll := bc.repo.Broker().Collection()
+	if err := coll.FindOne(ctx, bson.M{"_id": bc.id}).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	return &doc.Config, nil
+}
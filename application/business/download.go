@@ -0,0 +1,197 @@
+package business
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrDownloadBusy 下载排队已满。
+var ErrDownloadBusy = errors.New("下载任务繁忙，请稍后重试")
+
+// DownloadConfig 升级包下载调度配置。
+type DownloadConfig struct {
+	// Rate 所有下载任务合计的带宽上限（字节/秒），小于等于 0 代表不限制。
+	Rate int64
+
+	// Concurrent 最大并发下载数，小于等于 0 代表不限制。
+	Concurrent int
+
+	// Queue 超出并发数后最多排队的任务数，小于等于 0 代表不限制。
+	Queue int
+
+	// QueueTimeout 排队最长等待时间，小于等于 0 代表一直等到请求取消。
+	QueueTimeout time.Duration
+}
+
+// downloadChunk 每次读取的最大字节数，也是令牌桶的容量下限。
+const downloadChunk = 32 * 1024
+
+// NewDownloadScheduler 升级包下载调度器：限制合计带宽、并发数，超出并发的任务排队等待。
+//
+// 全网升级时大量节点同时下载，如果不加限制会占满 broker 的上行带宽，
+// 导致隧道内正常的 RPC 请求无法及时响应。
+func NewDownloadScheduler(cfg DownloadConfig) *DownloadScheduler {
+	ds := &DownloadScheduler{
+		limit: rate.NewLimiter(rate.Inf, downloadChunk),
+	}
+	ds.Update(cfg)
+
+	return ds
+}
+
+type DownloadScheduler struct {
+	limit   *rate.Limiter
+	mutex   sync.Mutex
+	cfg     DownloadConfig
+	active  int
+	waiters list.List // 排队中的任务 chan struct{}
+}
+
+// DownloadStats 下载调度状态。
+type DownloadStats struct {
+	Active     int   `json:"active"`     // 正在下载的任务数
+	Queued     int   `json:"queued"`     // 排队中的任务数
+	Rate       int64 `json:"rate"`       // 合计带宽上限（字节/秒）
+	Concurrent int   `json:"concurrent"` // 最大并发数
+}
+
+// Update 修改调度配置，立即生效。
+func (ds *DownloadScheduler) Update(cfg DownloadConfig) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	ds.cfg = cfg
+	if cfg.Rate > 0 {
+		ds.limit.SetLimit(rate.Limit(cfg.Rate))
+		ds.limit.SetBurst(max(int(cfg.Rate), downloadChunk))
+	} else {
+		ds.limit.SetLimit(rate.Inf)
+	}
+
+	// 并发数调大后唤醒排队的任务。
+	for ds.waiters.Len() != 0 && ds.available() {
+		ds.active++
+		ds.wakeFront()
+	}
+}
+
+func (ds *DownloadScheduler) Stats() DownloadStats {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	return DownloadStats{
+		Active:     ds.active,
+		Queued:     ds.waiters.Len(),
+		Rate:       ds.cfg.Rate,
+		Concurrent: ds.cfg.Concurrent,
+	}
+}
+
+// Acquire 申请下载名额，超出并发数时排队等待。成功后必须调用 release 归还名额。
+func (ds *DownloadScheduler) Acquire(ctx context.Context) (release func(), err error) {
+	ds.mutex.Lock()
+	if ds.available() {
+		ds.active++
+		ds.mutex.Unlock()
+		return ds.releaseFunc(), nil
+	}
+	if queue := ds.cfg.Queue; queue > 0 && ds.waiters.Len() >= queue {
+		ds.mutex.Unlock()
+		return nil, ErrDownloadBusy
+	}
+	ch := make(chan struct{})
+	elem := ds.waiters.PushBack(ch)
+	timeout := ds.cfg.QueueTimeout
+	ds.mutex.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-ch:
+		return ds.releaseFunc(), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-expired:
+		err = ErrDownloadBusy
+	}
+
+	ds.mutex.Lock()
+	select {
+	case <-ch: // 放弃的同时恰好轮到了，要把名额还回去。
+		ds.mutex.Unlock()
+		ds.releaseFunc()()
+	default:
+		ds.waiters.Remove(elem)
+		ds.mutex.Unlock()
+	}
+
+	return nil, err
+}
+
+// Reader 为下载的文件限速，所有下载任务共享同一个令牌桶。
+func (ds *DownloadScheduler) Reader(ctx context.Context, rs io.ReadSeeker) io.ReadSeeker {
+	return &limitReader{ctx: ctx, rs: rs, limit: ds.limit}
+}
+
+func (ds *DownloadScheduler) available() bool {
+	maximum := ds.cfg.Concurrent
+	return maximum <= 0 || ds.active < maximum
+}
+
+func (ds *DownloadScheduler) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ds.mutex.Lock()
+			defer ds.mutex.Unlock()
+
+			ds.active--
+			if ds.waiters.Len() != 0 && ds.available() {
+				ds.active++
+				ds.wakeFront()
+			}
+		})
+	}
+}
+
+// wakeFront 唤醒排在最前面的任务，调用方需持有锁。
+func (ds *DownloadScheduler) wakeFront() {
+	front := ds.waiters.Front()
+	ds.waiters.Remove(front)
+	close(front.Value.(chan struct{}))
+}
+
+type limitReader struct {
+	ctx   context.Context
+	rs    io.ReadSeeker
+	limit *rate.Limiter
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	if len(p) > downloadChunk {
+		p = p[:downloadChunk]
+	}
+	n, err := lr.rs.Read(p)
+	if n > 0 {
+		if werr := lr.limit.WaitN(lr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
+
+func (lr *limitReader) Seek(offset int64, whence int) (int64, error) {
+	return lr.rs.Seek(offset, whence)
+}
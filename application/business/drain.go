@@ -0,0 +1,274 @@
+package business
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xmx/aegis-broker/channel/rpclient"
+	"github.com/xmx/aegis-broker/channel/serverd"
+	"github.com/xmx/aegis-control/datalayer/model"
+	"github.com/xmx/aegis-control/datalayer/repository"
+)
+
+// 排空的各个阶段。
+const (
+	DrainIdle      = "idle"      // 没有在排空
+	DrainMigrating = "migrating" // 已通知节点迁移，等待节点下线
+	DrainShutdown  = "shutdown"  // 排空完毕，等待进程退出
+	DrainCanceled  = "canceled"  // 排空被取消
+)
+
+// ErrDrained 排空完毕，作为进程退出的原因。
+var ErrDrained = errors.New("broker 排空完毕")
+
+// DrainStatus 排空进度。
+type DrainStatus struct {
+	Stage     string    `json:"stage"`
+	Addresses []string  `json:"addresses,omitzero"`  // 通知节点迁移的接入点
+	Total     int       `json:"total,omitzero"`      // 开始排空时的在线节点数
+	Notified  int       `json:"notified,omitzero"`   // 成功通知迁移的节点数
+	Failed    int       `json:"failed,omitzero"`     // 通知迁移失败的节点数
+	Remain    int       `json:"remain"`              // 仍然在线的节点数
+	Kicked    int       `json:"kicked,omitzero"`     // 超时后被强制下线的节点数
+	Deadline  time.Time `json:"deadline,omitzero"`   // 等待节点下线的截止时间
+	StartedAt time.Time `json:"started_at,omitzero"` // 开始时间
+	UpdatedAt time.Time `json:"updated_at,omitzero"` // 更新时间
+}
+
+// NewDrainer 排空 broker，用于维护与滚动重启。
+//
+// shutdown 在排空完毕后调用，用于让进程退出。
+func NewDrainer(repo repository.All, cur *model.Broker, srv serverd.Server, cli rpclient.Client, shutdown context.CancelCauseFunc, log *slog.Logger) *Drainer {
+	return &Drainer{
+		repo:     repo,
+		cur:      cur,
+		srv:      srv,
+		cli:      cli,
+		shutdown: shutdown,
+		log:      log,
+		status:   DrainStatus{Stage: DrainIdle},
+	}
+}
+
+// Drainer 排空 broker。
+//
+// 排空流程：拒绝新节点上线 -> 通知在线节点迁移到其它 broker（setting.exposes 中除自己以外的接入点）
+// -> 等待节点自行下线 -> 超时后强制剩余节点下线 -> 进程退出。
+// 这样维护 broker 时节点会分批迁移，不会在 broker 退出的瞬间同时重连。
+type Drainer struct {
+	repo     repository.All
+	cur      *model.Broker
+	srv      serverd.Server
+	cli      rpclient.Client
+	shutdown context.CancelCauseFunc
+	log      *slog.Logger
+	running  atomic.Bool
+	mutex    sync.Mutex
+	cancel   context.CancelFunc
+	status   DrainStatus
+}
+
+// Status 排空进度。
+func (d *Drainer) Status() DrainStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	ret := d.status
+	ret.Remain = len(d.srv.Sessions())
+
+	return ret
+}
+
+// Start 在后台开始排空，timeout 为等待节点自行下线的最长时间。
+func (d *Drainer) Start(ctx context.Context, timeout time.Duration) error {
+	if !d.running.CompareAndSwap(false, true) {
+		return errors.New("正在排空中")
+	}
+
+	// 排空是个耗时操作，不能随着请求结束而取消。
+	bctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	d.mutex.Lock()
+	d.cancel = cancel
+	d.mutex.Unlock()
+
+	go d.run(bctx, timeout)
+
+	return nil
+}
+
+// Cancel 取消排空，恢复接受节点上线，已经迁移走的节点不会回来。
+func (d *Drainer) Cancel() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.running.Load() || d.cancel == nil {
+		return errors.New("没有在排空")
+	}
+	if d.status.Stage == DrainShutdown {
+		return errors.New("排空已完毕，无法取消")
+	}
+	d.cancel()
+
+	return nil
+}
+
+// Drain 同步排空，直到排空完毕或 ctx 取消，不会调用 shutdown。
+func (d *Drainer) Drain(ctx context.Context, timeout time.Duration) error {
+	if !d.running.CompareAndSwap(false, true) {
+		return errors.New("正在排空中")
+	}
+	defer d.running.Store(false)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d.mutex.Lock()
+	d.cancel = cancel
+	d.mutex.Unlock()
+
+	return d.drain(ctx, timeout)
+}
+
+func (d *Drainer) run(ctx context.Context, timeout time.Duration) {
+	defer d.running.Store(false)
+
+	if err := d.drain(ctx, timeout); err != nil {
+		d.log.Warn("排空被取消，恢复接受节点上线", "error", err)
+		return
+	}
+	d.setStage(DrainShutdown)
+	d.log.Warn("排空完毕，即将退出")
+	d.shutdown(ErrDrained)
+}
+
+func (d *Drainer) drain(ctx context.Context, timeout time.Duration) error {
+	d.srv.SetDraining(true)
+
+	now := time.Now()
+	sessions := d.srv.Sessions()
+	addresses := d.addresses(ctx)
+	d.mutex.Lock()
+	d.status = DrainStatus{
+		Stage:     DrainMigrating,
+		Addresses: addresses,
+		Total:     len(sessions),
+		Deadline:  now.Add(timeout),
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	d.mutex.Unlock()
+
+	attrs := []any{"total", len(sessions), "addresses", addresses, "timeout", timeout}
+	d.log.Warn("开始排空", attrs...)
+
+	if len(addresses) != 0 {
+		d.notify(ctx, sessions, addresses)
+	}
+	if err := d.wait(ctx, timeout); err != nil {
+		d.srv.SetDraining(false)
+		d.setStage(DrainCanceled)
+		return err
+	}
+
+	// 超时仍未下线的节点强制断开。
+	var kicked int
+	for _, sess := range d.srv.Sessions() {
+		if d.srv.Disconnect(sess.Peer.ID(), serverd.ReasonBrokerShutdown, "broker 排空") {
+			kicked++
+		}
+	}
+	d.mutex.Lock()
+	d.status.Kicked = kicked
+	d.status.UpdatedAt = time.Now()
+	d.mutex.Unlock()
+	d.log.Warn("排空等待结束", "kicked", kicked)
+
+	return nil
+}
+
+// addresses 节点可以迁移的接入点，排除自己的接入点。
+func (d *Drainer) addresses(ctx context.Context) []string {
+	setting, err := d.repo.Setting().Get(ctx)
+	if err != nil {
+		d.log.Warn("缺少全局配置（setting），节点将按照自身配置重连", "error", err)
+		return nil
+	}
+
+	owns := d.cur.Exposes.Addresses()
+	rets := make([]string, 0, len(setting.Exposes))
+	for _, addr := range setting.Exposes.Addresses() {
+		if !slices.Contains(owns, addr) {
+			rets = append(rets, addr)
+		}
+	}
+	if len(rets) == 0 {
+		d.log.Warn("全局配置缺少其它接入点（setting.exposes），节点将按照自身配置重连")
+	}
+
+	return rets
+}
+
+// notify 并发通知节点迁移。
+func (d *Drainer) notify(ctx context.Context, sessions []serverd.SessionStat, addresses []string) {
+	const concurrent = 32
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrent)
+	for _, sess := range sessions {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(sess serverd.SessionStat) {
+			defer func() { <-sem; wg.Done() }()
+
+			peer := sess.Peer
+			cctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			err := d.cli.Migrate(cctx, peer.ID().Hex(), addresses)
+			cancel()
+
+			d.mutex.Lock()
+			if err != nil {
+				d.status.Failed++
+			} else {
+				d.status.Notified++
+			}
+			d.status.UpdatedAt = time.Now()
+			d.mutex.Unlock()
+			if err != nil {
+				d.log.Warn("通知节点迁移失败", "info", peer.Info(), "error", err)
+			}
+		}(sess)
+	}
+	wg.Wait()
+}
+
+// wait 等待所有节点下线或超时，ctx 取消时返回错误。
+func (d *Drainer) wait(ctx context.Context, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for len(d.srv.Sessions()) != 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+func (d *Drainer) setStage(stage string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.status.Stage = stage
+	d.status.UpdatedAt = time.Now()
+}
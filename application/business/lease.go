@@ -0,0 +1,77 @@
+package business
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/xmx/aegis-control/datalayer/repository"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// NewLease broker 租约，保存在 broker 文档的 lease 字段。
+//
+// 续约与判断是否过期均使用数据库服务器的时间（$$NOW），不受各个 broker 之间时钟偏差的影响。
+// ttl 为租约有效期，续约间隔应远小于 ttl，一般取 ttl 的三分之一。
+func NewLease(repo repository.All, brokerID bson.ObjectID, ttl time.Duration) *Lease {
+	return &Lease{
+		repo: repo,
+		id:   brokerID,
+		ttl:  ttl,
+	}
+}
+
+type Lease struct {
+	repo repository.All
+	id   bson.ObjectID
+	ttl  time.Duration
+}
+
+// Interval 续约间隔。
+func (l *Lease) Interval() time.Duration {
+	return l.ttl / 3
+}
+
+// Renew 续约当前 broker 的租约。
+func (l *Lease) Renew(ctx context.Context) error {
+	return l.set(ctx, l.ttl)
+}
+
+// Release 释放当前 broker 的租约，正常退出时调用，其它 broker 可以立即接管节点。
+func (l *Lease) Release(ctx context.Context) error {
+	return l.set(ctx, 0)
+}
+
+// Alive 判断 broker 的租约是否有效，从未续约过（旧版本 broker）的视为有效。
+func (l *Lease) Alive(ctx context.Context, brokerID bson.ObjectID) (bool, error) {
+	filter := bson.M{
+		"_id": brokerID,
+		"$or": bson.A{
+			bson.M{"lease.expires_at": bson.M{"$exists": false}},
+			bson.M{"$expr": bson.M{"$gt": bson.A{"$lease.expires_at", "$$NOW"}}},
+		},
+	}
+	coll := l.repo.Broker().Collection()
+	err := coll.FindOne(ctx, filter).Err()
+	if err == nil {
+		return true, nil
+	} else if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+func (l *Lease) set(ctx context.Context, ttl time.Duration) error {
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"lease.renewed_at": "$$NOW",
+			"lease.expires_at": bson.M{"$add": bson.A{"$$NOW", ttl.Milliseconds()}},
+		}}},
+	}
+	repo := l.repo.Broker()
+	_, err := repo.UpdateByID(ctx, l.id, update)
+
+	return err
+}
@@ -0,0 +1,98 @@
+package business
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/xmx/aegis-control/datalayer/model"
+	"github.com/xmx/aegis-control/datalayer/repository"
+	"github.com/xmx/aegis-control/library/memoize"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// ErrPyroscopeDisabled 没有启用的 pyroscope 配置。
+var ErrPyroscopeDisabled = errors.New("pyroscope 未配置或未启用")
+
+func NewPyroscope(repo repository.All, log *slog.Logger) *Pyroscope {
+	p := &Pyroscope{
+		repo: repo,
+		log:  log,
+	}
+	p.cfg = memoize.NewCache2(p.enabled)
+
+	return p
+}
+
+type Pyroscope struct {
+	repo repository.All
+	log  *slog.Logger
+	cfg  memoize.Cache2[*PyroscopeUpstream, error]
+}
+
+// PyroscopeUpstream pyroscope 上游服务。
+type PyroscopeUpstream struct {
+	URL    *url.URL
+	Header http.Header // 认证与租户请求头
+}
+
+func (p *Pyroscope) Reset() {
+	_, _ = p.cfg.Forget()
+}
+
+// Upstream 获取当前启用的 pyroscope 上游。
+func (p *Pyroscope) Upstream(ctx context.Context) (*PyroscopeUpstream, error) {
+	up, err := p.cfg.Load(ctx)
+	if err != nil {
+		p.Reset() // 出错不缓存，下次重新查询。
+		return nil, err
+	}
+
+	return up, nil
+}
+
+// enabled 查询启用的 pyroscope 配置。
+//
+// 认证方式：Username 与 Password 均不为空时使用 Basic 认证，
+// 只有 Password 时将其作为 Bearer Token。
+// tenant 字段为多租户 ID，通过 X-Scope-OrgID 请求头传递。
+func (p *Pyroscope) enabled(ctx context.Context) (*PyroscopeUpstream, error) {
+	var doc struct {
+		model.Pyroscope `bson:",inline"`
+		Tenant          string `bson:"tenant"`
+	}
+
+	coll := p.repo.Pyroscope().Collection()
+	if err := coll.FindOne(ctx, bson.M{"enabled": true}).Decode(&doc); err != nil {
+		p.log.Warn("查询 pyroscope 配置出错", "error", err)
+		return nil, ErrPyroscopeDisabled
+	}
+
+	pu, err := url.Parse(doc.Address)
+	if err != nil {
+		return nil, err
+	}
+	if pu.Scheme != "http" && pu.Scheme != "https" {
+		return nil, errors.New("pyroscope 地址格式错误：" + doc.Address)
+	}
+
+	header := make(http.Header, 2)
+	if doc.Username != "" && doc.Password != "" {
+		req := &http.Request{Header: header}
+		req.SetBasicAuth(doc.Username, doc.Password)
+	} else if doc.Password != "" {
+		header.Set("Authorization", "Bearer "+doc.Password)
+	}
+	if doc.Tenant != "" {
+		header.Set("X-Scope-OrgID", doc.Tenant)
+	}
+
+	ret := &PyroscopeUpstream{
+		URL:    pu,
+		Header: header,
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,127 @@
+package business
+
+import (
+	"bytes"
+	"slices"
+	"time"
+
+	"github.com/xmx/aegis-broker/channel/serverd"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// NewTunnel 节点通道的运行时状态，直接读取内存中的连接会话，不查询数据库。
+func NewTunnel(srv serverd.Server) *Tunnel {
+	return &Tunnel{srv: srv}
+}
+
+type Tunnel struct {
+	srv serverd.Server
+}
+
+// TunnelStat 节点通道的运行时状态。
+//
+// 地址与流量均站在节点的视角，与数据库中 tunnel_stat 字段保持一致。
+type TunnelStat struct {
+	ID            bson.ObjectID `json:"id"`             // 节点 ID
+	SessionID     bson.ObjectID `json:"session_id"`     // 会话 ID
+	Host          string        `json:"host"`           // 通道主机名
+	MachineID     string        `json:"machine_id"`     // 机器码
+	Inet          string        `json:"inet"`           // 出口网卡 IP
+	Goos          string        `json:"goos"`           // 操作系统
+	Goarch        string        `json:"goarch"`         // 系统架构
+	Hostname      string        `json:"hostname"`       // 主机名
+	Semver        string        `json:"semver"`         // 版本号
+	Library       TunnelLibrary `json:"library"`        // 通道底层库
+	LocalAddr     string        `json:"local_addr"`     // 节点侧地址
+	RemoteAddr    string        `json:"remote_addr"`    // broker 侧地址
+	ReceiveBytes  uint64        `json:"receive_bytes"`  // 节点接收字节数
+	TransmitBytes uint64        `json:"transmit_bytes"` // 节点发送字节数
+	Streams       TunnelStreams `json:"streams"`        // 子流数量
+	Limit         int64         `json:"limit"`          // 通道当前实际的限速（KiB/s），0 代表不限制
+	ConnectedAt   time.Time     `json:"connected_at"`   // 上线时间
+	KeepaliveAt   time.Time     `json:"keepalive_at"`   // 最近一次心跳时间
+	RTT           int64         `json:"rtt"`            // 最近一次主动探测的 RTT（毫秒），没有探测过为 0
+	Duration      int64         `json:"duration"`       // 在线时长（秒）
+}
+
+type TunnelLibrary struct {
+	Name   string `json:"name"`
+	Module string `json:"module"`
+}
+
+type TunnelStreams struct {
+	Cumulative int64 `json:"cumulative"` // 累计打开的子流数
+	Active     int64 `json:"active"`     // 当前活跃的子流数
+}
+
+// Stats 当前 broker 上所有在线节点的通道状态，按上线时间倒序排列。
+func (tnl *Tunnel) Stats() []*TunnelStat {
+	now := time.Now()
+	sessions := tnl.srv.Sessions()
+	rets := make([]*TunnelStat, 0, len(sessions))
+	for _, sess := range sessions {
+		rets = append(rets, newTunnelStat(sess, now))
+	}
+	slices.SortFunc(rets, func(a, b *TunnelStat) int {
+		if n := b.ConnectedAt.Compare(a.ConnectedAt); n != 0 {
+			return n
+		}
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+
+	return rets
+}
+
+// Stat 查询节点的通道状态，节点不在当前 broker 上在线时返回 nil。
+func (tnl *Tunnel) Stat(agentID bson.ObjectID) *TunnelStat {
+	sess, ok := tnl.srv.Session(agentID)
+	if !ok {
+		return nil
+	}
+
+	return newTunnelStat(sess, time.Now())
+}
+
+func newTunnelStat(sess serverd.SessionStat, now time.Time) *TunnelStat {
+	peer := sess.Peer
+	info := peer.Info()
+	mux := peer.Muxer()
+	libName, libModule := mux.Library()
+	raddr, laddr := mux.Addr(), mux.RemoteAddr() // 互换
+	tx, rx := mux.Traffic()                      // 互换
+	cumulative, active := mux.NumStreams()
+
+	return &TunnelStat{
+		ID:            peer.ID(),
+		SessionID:     sess.ID,
+		Host:          peer.Host(),
+		MachineID:     info.Name,
+		Inet:          info.Inet,
+		Goos:          info.Goos,
+		Goarch:        info.Goarch,
+		Hostname:      info.Hostname,
+		Semver:        info.Semver,
+		Library:       TunnelLibrary{Name: libName, Module: libModule},
+		LocalAddr:     laddr.String(),
+		RemoteAddr:    raddr.String(),
+		ReceiveBytes:  rx,
+		TransmitBytes: tx,
+		Streams:       TunnelStreams{Cumulative: cumulative, Active: active},
+		Limit:         limitToKiB(mux.Limit()),
+		ConnectedAt:   sess.ConnectAt,
+		KeepaliveAt:   sess.KeepaliveAt,
+		RTT:           sess.RTT.Milliseconds(),
+		Duration:      int64(now.Sub(sess.ConnectAt).Seconds()),
+	}
+}
+
+// Kick 强制节点下线，ban 大于 0 时在该时长内禁止节点再次上线（对所有 broker 生效）。
+// 返回节点是否在线。
+func (tnl *Tunnel) Kick(agentID bson.ObjectID, reason string, ban time.Duration) (bool, error) {
+	return tnl.srv.Kick(agentID, reason, ban)
+}
+
+// Unban 解除节点的上线封禁。
+func (tnl *Tunnel) Unban(agentID bson.ObjectID) error {
+	return tnl.srv.Unban(agentID)
+}
@@ -0,0 +1,222 @@
+package business
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/xmx/aegis-broker/channel/rpclient"
+	"github.com/xmx/aegis-broker/channel/serverd"
+	"github.com/xmx/aegis-control/linkhub"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// 节点通道事件类型。
+const (
+	TunnelEventConnected    = "connected"    // 节点上线
+	TunnelEventDisconnected = "disconnected" // 节点下线
+	TunnelEventTakeover     = "takeover"     // 节点重新上线，旧连接被新连接接管下线
+)
+
+// TunnelEvent 节点通道的上下线事件。
+type TunnelEvent struct {
+	BootID         bson.ObjectID             `json:"boot_id"`                  // broker 进程启动 ID，进程重启后序号从头开始，以 boot_id + seq 唯一标识事件
+	Seq            uint64                    `json:"seq"`                      // 事件序号，broker 进程内单调递增
+	Type           string                    `json:"type"`                     // 事件类型
+	BrokerID       bson.ObjectID             `json:"broker_id"`                // broker ID
+	AgentID        bson.ObjectID             `json:"agent_id"`                 // 节点 ID
+	MachineID      string                    `json:"machine_id"`               // 机器码
+	Inet           string                    `json:"inet"`                     // 出口网卡 IP
+	Goos           string                    `json:"goos"`                     // 操作系统
+	Goarch         string                    `json:"goarch"`                   // 系统架构
+	Hostname       string                    `json:"hostname"`                 // 主机名
+	Semver         string                    `json:"semver"`                   // 版本号
+	ConnectedAt    time.Time                 `json:"connected_at"`             // 上线时间
+	DisconnectedAt time.Time                 `json:"disconnected_at,omitzero"` // 下线时间
+	Reason         *serverd.DisconnectReason `json:"reason,omitzero"`          // 下线原因
+	CreatedAt      time.Time                 `json:"created_at"`               // 事件产生时间
+}
+
+// NewTunnelEvents 节点通道上下线事件，作为 serverd 的 ServerHooker 使用。
+//
+// 事件保存在容量为 capacity 的内存队列中，由定时任务调用 Flush 批量上报给中心端，
+// 上报失败（如中心端通道正在重连）的事件留在队列中，下次 Flush 时重新上报。
+// 队列满时丢弃最旧的事件。
+//
+// 每次创建都会生成新的启动 ID，附加在每个事件上，中心端据此区分 broker 重启前后序号相同的事件。
+func NewTunnelEvents(cli rpclient.Client, brokerID bson.ObjectID, capacity int, log *slog.Logger) *TunnelEvents {
+	if capacity <= 0 {
+		capacity = 10000
+	}
+
+	return &TunnelEvents{
+		cli:      cli,
+		brokerID: brokerID,
+		bootID:   bson.NewObjectID(),
+		log:      log,
+		events:   make([]*TunnelEvent, capacity),
+		subs:     make(map[chan *TunnelEvent]struct{}),
+	}
+}
+
+type TunnelEvents struct {
+	cli      rpclient.Client
+	brokerID bson.ObjectID
+	bootID   bson.ObjectID
+	log      *slog.Logger
+	mutex    sync.Mutex
+	events   []*TunnelEvent // 环形队列，序号为 seq 的事件保存在 events[seq%len(events)]
+	size     int            // 环形队列中的事件数
+	seq      uint64         // 最新事件的序号
+	acked    uint64         // 已经上报给中心端的最大序号
+	dropped  uint64         // 未上报就被丢弃的事件数
+	subs     map[chan *TunnelEvent]struct{}
+	flushMu  sync.Mutex
+}
+
+// OnConnected 实现了 PeerHooker 后不会被调用。
+func (*TunnelEvents) OnConnected(linkhub.Info, time.Time) {}
+
+// OnDisconnected 实现了 PeerHooker 后不会被调用。
+func (*TunnelEvents) OnDisconnected(linkhub.Info, time.Time, time.Time) {}
+
+func (te *TunnelEvents) OnPeerConnected(peer linkhub.Peer, connectAt time.Time) {
+	evt := te.newEvent(TunnelEventConnected, peer, connectAt)
+	te.publish(evt)
+}
+
+func (te *TunnelEvents) OnPeerDisconnected(peer linkhub.Peer, connectAt, disconnectAt time.Time, reason serverd.DisconnectReason) {
+	typ := TunnelEventDisconnected
+	if reason.Category == serverd.ReasonTakeover {
+		typ = TunnelEventTakeover
+	}
+	evt := te.newEvent(typ, peer, connectAt)
+	evt.DisconnectedAt = disconnectAt
+	evt.Reason = &reason
+	te.publish(evt)
+}
+
+// Since 内存中序号大于 seq 的事件，用于订阅者断线重连后补发。
+func (te *TunnelEvents) Since(seq uint64) []*TunnelEvent {
+	te.mutex.Lock()
+	defer te.mutex.Unlock()
+
+	return te.since(seq, te.size)
+}
+
+// BootID 本进程的启动 ID。
+func (te *TunnelEvents) BootID() bson.ObjectID {
+	return te.bootID
+}
+
+// Subscribe 订阅实时事件，size 为通道缓冲大小。
+//
+// 订阅者消费太慢导致缓冲满时，新事件会被跳过，订阅者可以根据序号不连续发现并调用 Since 补发。
+// 不再订阅时必须调用返回的 cancel。
+func (te *TunnelEvents) Subscribe(size int) (<-chan *TunnelEvent, func()) {
+	ch := make(chan *TunnelEvent, size)
+	te.mutex.Lock()
+	te.subs[ch] = struct{}{}
+	te.mutex.Unlock()
+
+	cancel := func() {
+		te.mutex.Lock()
+		delete(te.subs, ch)
+		te.mutex.Unlock()
+	}
+
+	return ch, cancel
+}
+
+// Flush 将未上报的事件分批上报给中心端，直到全部上报或者出错。
+func (te *TunnelEvents) Flush(ctx context.Context) error {
+	const batch = 200
+
+	te.flushMu.Lock()
+	defer te.flushMu.Unlock()
+
+	for {
+		te.mutex.Lock()
+		events := te.since(te.acked, batch)
+		te.mutex.Unlock()
+		if len(events) == 0 {
+			return nil
+		}
+
+		if err := te.cli.TunnelEvents(ctx, events); err != nil {
+			te.log.Warn("上报节点通道事件出错，稍后重试", "pending", len(events), "error", err)
+			return err
+		}
+
+		last := events[len(events)-1].Seq
+		te.mutex.Lock()
+		te.acked = max(te.acked, last)
+		te.mutex.Unlock()
+	}
+}
+
+func (te *TunnelEvents) newEvent(typ string, peer linkhub.Peer, connectAt time.Time) *TunnelEvent {
+	info := peer.Info()
+
+	return &TunnelEvent{
+		BootID:      te.bootID,
+		Type:        typ,
+		BrokerID:    te.brokerID,
+		AgentID:     peer.ID(),
+		MachineID:   info.Name,
+		Inet:        info.Inet,
+		Goos:        info.Goos,
+		Goarch:      info.Goarch,
+		Hostname:    info.Hostname,
+		Semver:      info.Semver,
+		ConnectedAt: connectAt,
+		CreatedAt:   time.Now(),
+	}
+}
+
+func (te *TunnelEvents) publish(evt *TunnelEvent) {
+	te.mutex.Lock()
+	defer te.mutex.Unlock()
+
+	te.seq++
+	evt.Seq = te.seq
+	capacity := len(te.events)
+	idx := int(te.seq % uint64(capacity))
+	if te.size == capacity {
+		if old := te.events[idx]; old.Seq > te.acked {
+			te.dropped++
+			if te.dropped%1000 == 1 {
+				te.log.Warn("节点通道事件队列已满，丢弃未上报的事件", "capacity", capacity, "dropped", te.dropped)
+			}
+		}
+	} else {
+		te.size++
+	}
+	te.events[idx] = evt
+
+	for ch := range te.subs {
+		select {
+		case ch <- evt:
+		default:
+		}
+	}
+}
+
+// since 序号大于 seq 的最多 limit 个事件，调用方需要持有锁。
+func (te *TunnelEvents) since(seq uint64, limit int) []*TunnelEvent {
+	oldest := te.seq - uint64(te.size) + 1
+	start := max(seq+1, oldest)
+	if start > te.seq {
+		return nil
+	}
+
+	n := min(uint64(limit), te.seq-start+1)
+	rets := make([]*TunnelEvent, 0, n)
+	capacity := uint64(len(te.events))
+	for i := start; i < start+n; i++ {
+		rets = append(rets, te.events[i%capacity])
+	}
+
+	return rets
+}
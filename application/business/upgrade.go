@@ -0,0 +1,416 @@
+package business
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xmx/aegis-broker/config"
+	"github.com/xmx/aegis-broker/supervisor"
+	"github.com/xmx/aegis-common/banner"
+	"github.com/xmx/aegis-common/stegano"
+	"github.com/xmx/aegis-control/datalayer/model"
+	"github.com/xmx/aegis-control/datalayer/repository"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// 升级的各个阶段。
+const (
+	UpgradeIdle        = "idle"        // 没有在升级
+	UpgradeDownloading = "downloading" // 下载中
+	UpgradeVerifying   = "verifying"   // 校验中
+	UpgradeInstalling  = "installing"  // 写入隐写配置、替换程序
+	UpgradeRestarting  = "restarting"  // 等待重启
+	UpgradeFailed      = "failed"      // 升级失败
+)
+
+// UpgradeStatus 升级进度。
+type UpgradeStatus struct {
+	Stage     string    `json:"stage"`
+	Current   string    `json:"current"`
+	Target    string    `json:"target,omitzero"`
+	Filename  string    `json:"filename,omitzero"`
+	Total     int64     `json:"total,omitzero"`
+	Written   int64     `json:"written,omitzero"`
+	Error     string    `json:"error,omitzero"`
+	StartedAt time.Time `json:"started_at,omitzero"`
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
+}
+
+// NewUpgrader broker 自升级。
+//
+// restart 在升级完毕后以 supervisor.ErrRestart 为原因调用，让进程优雅关闭后再由 supervisor 重启。
+func NewUpgrader(repo repository.All, hide *config.Config, sup supervisor.Supervisor, restart context.CancelCauseFunc, log *slog.Logger) *Upgrader {
+	info := banner.SelfInfo()
+	return &Upgrader{
+		repo:    repo,
+		hide:    hide,
+		sup:     sup,
+		restart: restart,
+		log:     log,
+		status:  UpgradeStatus{Stage: UpgradeIdle, Current: info.Semver},
+	}
+}
+
+// Upgrader broker 自升级。
+//
+// 升级流程：从 GridFS 下载新版本到临时文件 -> 校验大小、哈希、签名 -> 在文件末尾重新写入隐写配置
+// -> 原子重命名为带版本号的文件 -> 写入升级标记 -> 原子替换入口符号链接 -> 通过 supervisor 重启。
+// 旧版本的程序会保留，新版本启动失败时由 UpgradeGate 回滚。
+type Upgrader struct {
+	repo    repository.All
+	hide    *config.Config
+	sup     supervisor.Supervisor
+	restart context.CancelCauseFunc
+	log     *slog.Logger
+	running atomic.Bool
+	written atomic.Int64
+	mutex   sync.Mutex
+	status  UpgradeStatus
+}
+
+// Status 升级进度。
+func (u *Upgrader) Status() UpgradeStatus {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	ret := u.status
+	if ret.Stage == UpgradeDownloading {
+		ret.Written = u.written.Load()
+	}
+
+	return ret
+}
+
+// Start 检查是否有新版本，有则在后台开始升级。
+func (u *Upgrader) Start(ctx context.Context) (bool, error) {
+	if !u.running.CompareAndSwap(false, true) {
+		return false, errors.New("正在升级中")
+	}
+
+	latest, err := u.latest(ctx)
+	if err != nil || latest == nil {
+		u.running.Store(false)
+		return false, err
+	}
+
+	// 升级是个耗时操作，不能随着请求结束而取消。
+	bctx := context.WithoutCancel(ctx)
+	go u.run(bctx, latest)
+
+	return true, nil
+}
+
+func (u *Upgrader) latest(ctx context.Context) (*model.BrokerRelease, error) {
+	info := banner.SelfInfo()
+	num := model.ParseSemver(info.Semver)
+
+	attrs := []any{"current", info}
+	u.log.Info("检查升级", attrs...)
+	filter := bson.M{"goos": info.Goos, "goarch": info.Goarch, "version": bson.M{"$gt": num}}
+	opt := options.FindOne().SetSort(bson.M{"version": -1})
+	repo := u.repo.BrokerRelease()
+	latest, err := repo.FindOne(ctx, filter, opt)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			u.log.Info("没有找到更新的版本", attrs...)
+			return nil, nil
+		}
+		attrs = append(attrs, "error", err)
+		u.log.Warn("检查新版本出错", attrs...)
+		return nil, err
+	}
+	attrs = append(attrs, "latest", latest)
+	u.log.Info("找到了新的版本", attrs...)
+
+	setting, err := u.repo.Setting().Get(ctx)
+	if err != nil {
+		attrs = append(attrs, "error", err)
+		u.log.Warn("缺少全局配置（setting）", attrs...)
+		return nil, err
+	}
+	if addresses := setting.Exposes.Addresses(); len(addresses) == 0 {
+		u.log.Warn("全局配置缺少接入点（setting.exposes）", attrs...)
+		return nil, errors.New("全局配置缺少接入点")
+	}
+
+	return latest, nil
+}
+
+func (u *Upgrader) run(parent context.Context, release *model.BrokerRelease) {
+	defer u.running.Store(false)
+
+	ctx, cancel := context.WithTimeout(parent, 30*time.Minute)
+	defer cancel()
+
+	attrs := []any{"target", release.Semver, "filename", release.Filename}
+	u.log.Warn("开始升级", attrs...)
+
+	now := time.Now()
+	u.written.Store(0)
+	u.mutex.Lock()
+	u.status.Stage = UpgradeDownloading
+	u.status.Target = release.Semver
+	u.status.Filename = release.Filename
+	u.status.Total = release.Length
+	u.status.Written = 0
+	u.status.Error = ""
+	u.status.StartedAt = now
+	u.status.UpdatedAt = now
+	u.mutex.Unlock()
+
+	if err := u.upgrade(ctx, release); err != nil {
+		attrs = append(attrs, "error", err)
+		u.log.Error("升级失败", attrs...)
+		u.setStage(UpgradeFailed, err)
+		return
+	}
+
+	u.setStage(UpgradeRestarting, nil)
+	u.log.Warn("升级完毕，优雅关闭后重启", attrs...)
+	u.restart(supervisor.ErrRestart)
+}
+
+//goland:noinspection GoUnhandledErrorResult
+func (u *Upgrader) upgrade(ctx context.Context, release *model.BrokerRelease) error {
+	// 没有能够重启进程的守护方式时不升级，否则新版本落地后无法启动，回滚检查也不会执行。
+	if err := u.sup.Check(); err != nil {
+		return fmt.Errorf("无法通过 %s 重启进程：%w", u.sup.Name(), err)
+	}
+
+	link, err := supervisor.Executable()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(link)
+	name := filepath.Base(release.Filename)
+	if name == "." || name == string(filepath.Separator) || name == supervisor.LinkName {
+		name = supervisor.LinkName + "-" + release.Semver
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // 重命名成功后就删不掉了，不影响。
+	defer tmp.Close()
+
+	size, sum, err := u.download(ctx, tmp, release)
+	if err != nil {
+		return err
+	}
+
+	u.setStage(UpgradeVerifying, nil)
+	if err = u.verify(ctx, release, size, sum); err != nil {
+		return err
+	}
+
+	// 写入隐写配置，新版本启动时从自身读取。
+	u.setStage(UpgradeInstalling, nil)
+	hide := *u.hide
+	hide.Offset = size
+	if hide.Semver != "" {
+		hide.Semver = release.Semver
+	}
+	buf, err := stegano.CreateManifestZip(hide, size)
+	if err != nil {
+		return err
+	}
+	if _, err = buf.WriteTo(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpName, 0o755); err != nil {
+		return err
+	}
+	if _, err = stegano.File[config.Config](tmpName).Read(); err != nil {
+		return errors.New("隐写配置写入后无法读取：" + err.Error())
+	}
+
+	previous, err := u.previous(dir)
+	if err != nil {
+		return err
+	}
+	if previous == name {
+		return errors.New("新版本与当前程序的文件名相同")
+	}
+	binary := filepath.Join(dir, name)
+	if err = os.Rename(tmpName, binary); err != nil {
+		return err
+	}
+
+	// 保留旧版本并写入升级标记，新版本启动失败时由 UpgradeGate 回滚。
+	info := banner.SelfInfo()
+	now := time.Now()
+	mk := &upgradeMarker{
+		From:      info.Semver,
+		To:        release.Semver,
+		Previous:  previous,
+		Target:    name,
+		Outcome:   UpgradeProbation,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	if err = writeUpgradeMarker(dir, mk); err != nil {
+		return err
+	}
+	if err = relink(dir, name); err != nil {
+		_ = removeUpgradeMarker(dir)
+		return err
+	}
+
+	return nil
+}
+
+// previous 当前正在运行的程序文件名，升级后作为回滚的目标保留。
+//
+// 如果入口文件不是符号链接而是程序本身，先将其按版本号重命名，腾出位置给符号链接。
+func (u *Upgrader) previous(dir string) (string, error) {
+	link := filepath.Join(dir, supervisor.LinkName)
+	if fi, err := os.Lstat(link); err == nil && fi.Mode().IsRegular() {
+		info := banner.SelfInfo()
+		name := supervisor.LinkName + "-" + info.Semver
+		if err = os.Rename(link, filepath.Join(dir, name)); err != nil {
+			return "", err
+		}
+		if err = relink(dir, name); err != nil {
+			return "", err
+		}
+
+		return name, nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if self, err = filepath.EvalSymlinks(self); err != nil {
+		return "", err
+	}
+	if filepath.Dir(self) != dir {
+		return "", errors.New("当前程序与入口文件不在同一目录")
+	}
+
+	return filepath.Base(self), nil
+}
+
+// download 下载新版本到 w，返回文件大小与哈希值。
+//
+//goland:noinspection GoUnhandledErrorResult
+func (u *Upgrader) download(ctx context.Context, w io.Writer, release *model.BrokerRelease) (int64, model.Checksum, error) {
+	stm, err := u.repo.BrokerRelease().OpenFile(ctx, release.FileID)
+	if err != nil {
+		return 0, model.Checksum{}, err
+	}
+	defer stm.Close()
+
+	hw := model.NewHashWriter()
+	pw := &progressWriter{n: &u.written}
+	size, err := io.Copy(io.MultiWriter(w, hw, pw), stm)
+	if err != nil {
+		return 0, model.Checksum{}, err
+	}
+
+	return size, hw.Sum(), nil
+}
+
+// verify 校验文件大小、哈希值以及签名。
+func (u *Upgrader) verify(ctx context.Context, release *model.BrokerRelease, size int64, sum model.Checksum) error {
+	if length := release.Length; length > 0 && length != size {
+		return errors.New("文件大小不一致")
+	}
+
+	want := release.Checksum
+	if want.IsZero() {
+		return errors.New("升级包缺少校验值")
+	}
+	got := sum.Map()
+	for k, v := range want.Map() {
+		if v != "" && !strings.EqualFold(v, got[k]) {
+			return errors.New("升级包 " + k + " 校验不通过")
+		}
+	}
+
+	if u.hide.PublicKey == "" {
+		return nil
+	}
+
+	return u.verifySignature(ctx, release.ID, sum.SHA256)
+}
+
+// verifySignature 校验升级包签名：对程序 SHA-256 摘要的 ed25519 签名（base64 编码），
+// 存放在升级包记录的 signature 字段中。
+func (u *Upgrader) verifySignature(ctx context.Context, id bson.ObjectID, sha256sum string) error {
+	pub, err := base64.StdEncoding.DecodeString(u.hide.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("升级包签名公钥格式错误")
+	}
+
+	var doc struct {
+		Signature string `bson:"signature"`
+	}
+	coll := u.repo.BrokerRelease().Collection()
+	opt := options.FindOne().SetProjection(bson.M{"signature": 1})
+	if err = coll.FindOne(ctx, bson.M{"_id": id}, opt).Decode(&doc); err != nil {
+		return err
+	}
+	if doc.Signature == "" {
+		return errors.New("升级包缺少签名")
+	}
+	sig, err := base64.StdEncoding.DecodeString(doc.Signature)
+	if err != nil {
+		return errors.New("升级包签名格式错误")
+	}
+	digest, err := hex.DecodeString(sha256sum)
+	if err != nil || len(digest) != sha256.Size {
+		return errors.New("升级包摘要格式错误")
+	}
+	if !ed25519.Verify(pub, digest, sig) {
+		return errors.New("升级包签名校验不通过")
+	}
+
+	return nil
+}
+
+func (u *Upgrader) setStage(stage string, err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.status.Stage = stage
+	u.status.Written = u.written.Load()
+	u.status.UpdatedAt = time.Now()
+	if err != nil {
+		u.status.Error = err.Error()
+	}
+}
+
+type progressWriter struct {
+	n *atomic.Int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	pw.n.Add(int64(n))
+
+	return n, nil
+}
@@ -0,0 +1,279 @@
+package business
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/xmx/aegis-broker/supervisor"
+	"github.com/xmx/aegis-control/datalayer/repository"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// 升级结果。
+const (
+	UpgradeProbation  = "probation"   // 新版本已启动，等待确认
+	UpgradeSucceeded  = "succeeded"   // 新版本启动成功
+	UpgradeRolledBack = "rolled_back" // 新版本启动失败，已回滚
+)
+
+const (
+	upgradeMarkerName  = ".aegis-broker.upgrade.json"
+	upgradeMaxAttempts = 3               // 新版本最多启动几次
+	upgradeHealthDelay = 3 * time.Minute // 新版本每次启动确认健康的期限
+)
+
+// upgradeMarker 升级标记，与程序放在同一目录，用于新旧版本进程之间传递升级状态。
+type upgradeMarker struct {
+	From      string    `json:"from"`       // 旧版本号
+	To        string    `json:"to"`         // 新版本号
+	Previous  string    `json:"previous"`   // 旧版本的文件名
+	Target    string    `json:"target"`     // 新版本的文件名
+	Outcome   string    `json:"outcome"`    // 升级结果
+	Reason    string    `json:"reason"`     // 回滚原因
+	Attempts  int       `json:"attempts"`   // 新版本已启动次数
+	StartedAt time.Time `json:"started_at"` // 开始升级的时间
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NewUpgradeGate 升级健康检查关卡。
+//
+// 新版本启动后必须在期限内完成：连接中心端认证通过、连接数据库、监听服务成功，
+// 然后调用 Confirm 确认升级成功。如果超时或反复启动失败，就将入口链接指回旧版本，
+// 并以 supervisor.ErrRestart 为原因调用 restart，优雅关闭后重启。
+func NewUpgradeGate(sup supervisor.Supervisor, restart context.CancelCauseFunc, log *slog.Logger) *UpgradeGate {
+	return &UpgradeGate{
+		sup:     sup,
+		restart: restart,
+		log:     log,
+	}
+}
+
+type UpgradeGate struct {
+	sup     supervisor.Supervisor
+	restart context.CancelCauseFunc
+	log     *slog.Logger
+	mutex   sync.Mutex
+	dir     string
+	marker  *upgradeMarker
+	timer   *time.Timer
+}
+
+// ErrUpgradeRollback 新版本启动失败，已经回滚并即将重启。
+var ErrUpgradeRollback = errors.New("升级失败已回滚，等待重启")
+
+// Begin 进程启动时调用：如果当前是刚升级的新版本，就开始健康检查倒计时。
+//
+// 返回 ErrUpgradeRollback 时已经安排了重启，调用方不应继续启动。
+func (g *UpgradeGate) Begin() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	link, err := supervisor.Executable()
+	if err != nil {
+		return nil
+	}
+	g.dir = filepath.Dir(link)
+	mk, err := readUpgradeMarker(g.dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			g.log.Warn("读取升级标记出错", "error", err)
+			_ = removeUpgradeMarker(g.dir)
+		}
+		return nil
+	}
+
+	self, _ := os.Executable()
+	self, _ = filepath.EvalSymlinks(self)
+	name := filepath.Base(self)
+	attrs := []any{"from", mk.From, "to", mk.To, "self", name}
+	switch {
+	case mk.Outcome == UpgradeProbation && name == mk.Target:
+	case mk.Outcome == UpgradeRolledBack && name == mk.Previous:
+		g.marker = mk // 回滚后的旧版本，等待连上数据库后记录结果。
+		return nil
+	default:
+		g.log.Warn("升级标记与当前程序不匹配，忽略", attrs...)
+		_ = removeUpgradeMarker(g.dir)
+		return nil
+	}
+
+	g.marker = mk
+	mk.Attempts++
+	if mk.Attempts > upgradeMaxAttempts {
+		return g.rollbackLocked("新版本多次启动失败")
+	}
+	mk.UpdatedAt = time.Now()
+	_ = writeUpgradeMarker(g.dir, mk)
+
+	attrs = append(attrs, "attempts", mk.Attempts, "deadline", upgradeHealthDelay)
+	g.log.Warn("新版本启动中，等待健康确认", attrs...)
+	g.timer = time.AfterFunc(upgradeHealthDelay, g.timeout)
+
+	return nil
+}
+
+// Confirm 启动完毕后调用：确认升级成功，或者记录回滚的结果。
+func (g *UpgradeGate) Confirm(ctx context.Context, repo repository.All, brokerID bson.ObjectID) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	mk := g.marker
+	if mk == nil {
+		return
+	}
+	if g.timer != nil && !g.timer.Stop() {
+		return // 已经超时回滚了
+	}
+
+	attrs := []any{"from", mk.From, "to", mk.To}
+	if mk.Outcome == UpgradeProbation {
+		mk.Outcome = UpgradeSucceeded
+		g.log.Warn("新版本启动成功，升级完毕", attrs...)
+	} else {
+		attrs = append(attrs, "reason", mk.Reason)
+		g.log.Error("升级失败已回滚到旧版本", attrs...)
+	}
+
+	mk.UpdatedAt = time.Now()
+	update := bson.M{"$set": bson.M{"upgrade": bson.M{
+		"from":       mk.From,
+		"to":         mk.To,
+		"outcome":    mk.Outcome,
+		"reason":     mk.Reason,
+		"attempts":   mk.Attempts,
+		"started_at": mk.StartedAt,
+		"updated_at": mk.UpdatedAt,
+	}}}
+	if _, err := repo.Broker().UpdateByID(ctx, brokerID, update); err != nil {
+		attrs = append(attrs, "error", err)
+		g.log.Warn("记录升级结果出错", attrs...)
+	}
+
+	_ = removeUpgradeMarker(g.dir)
+	g.marker = nil
+}
+
+func (g *UpgradeGate) timeout() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.marker == nil {
+		return
+	}
+	_ = g.rollbackLocked("新版本未在期限内通过健康检查")
+}
+
+func (g *UpgradeGate) rollbackLocked(reason string) error {
+	mk := g.marker
+	attrs := []any{"from", mk.From, "to", mk.To, "reason", reason}
+	g.log.Error("升级失败，开始回滚", attrs...)
+
+	if err := relink(g.dir, mk.Previous); err != nil {
+		attrs = append(attrs, "error", err)
+		g.log.Error("回滚失败，入口链接无法指向旧版本", attrs...)
+		return err
+	}
+	mk.Outcome = UpgradeRolledBack
+	mk.Reason = reason
+	mk.UpdatedAt = time.Now()
+	if err := writeUpgradeMarker(g.dir, mk); err != nil {
+		g.log.Warn("写入升级标记出错", "error", err)
+	}
+
+	if err := g.sup.Check(); err != nil {
+		attrs = append(attrs, "supervisor", g.sup.Name(), "error", err)
+		g.log.Error("已回滚但无法重启，请手动重启", attrs...)
+		return err
+	}
+	g.restart(supervisor.ErrRestart)
+
+	return ErrUpgradeRollback
+}
+
+// AbortUpgrade 升级完毕但是无法重启进程（如：原地替换进程失败）时调用。
+//
+// 将入口链接指回当前正在运行的旧版本，并将升级标记为失败，由当前进程重新启动服务，
+// 启动后 UpgradeGate 会记录升级失败的结果。当前进程就是待回滚的新版本时返回错误，不能继续运行。
+func AbortUpgrade(reason string) error {
+	link, err := supervisor.Executable()
+	if err != nil {
+		return nil
+	}
+	dir := filepath.Dir(link)
+	mk, err := readUpgradeMarker(dir)
+	if err != nil {
+		return nil
+	}
+
+	self, _ := os.Executable()
+	self, _ = filepath.EvalSymlinks(self)
+	name := filepath.Base(self)
+	if name != mk.Previous {
+		return errors.New("当前程序不是升级前的版本，无法继续运行")
+	}
+	if mk.Outcome != UpgradeProbation {
+		return nil
+	}
+	if err = relink(dir, mk.Previous); err != nil {
+		return err
+	}
+	mk.Outcome = UpgradeRolledBack
+	mk.Reason = reason
+	mk.UpdatedAt = time.Now()
+
+	return writeUpgradeMarker(dir, mk)
+}
+
+// relink 原子替换入口符号链接：先创建临时链接，再重命名覆盖。
+func relink(dir, target string) error {
+	link := filepath.Join(dir, supervisor.LinkName)
+	tmp := filepath.Join(dir, "."+supervisor.LinkName+".link")
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func readUpgradeMarker(dir string) (*upgradeMarker, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, upgradeMarkerName))
+	if err != nil {
+		return nil, err
+	}
+	mk := new(upgradeMarker)
+	if err = json.Unmarshal(raw, mk); err != nil {
+		return nil, err
+	}
+
+	return mk, nil
+}
+
+// writeUpgradeMarker 先写临时文件再重命名，避免写一半断电导致标记损坏。
+func writeUpgradeMarker(dir string, mk *upgradeMarker) error {
+	raw, err := json.Marshal(mk)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, upgradeMarkerName)
+	tmp := name + ".tmp"
+	if err = os.WriteFile(tmp, raw, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+func removeUpgradeMarker(dir string) error {
+	return os.Remove(filepath.Join(dir, upgradeMarkerName))
+}
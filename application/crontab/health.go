@@ -5,18 +5,21 @@ import (
 	"time"
 
 	"github.com/robfig/cron/v3"
+	"github.com/xmx/aegis-broker/channel/clientd"
 	"github.com/xmx/aegis-broker/channel/rpclient"
 	"github.com/xmx/aegis-common/library/cronv3"
 )
 
-func NewHealth(cli rpclient.Client) cronv3.Tasker {
+func NewHealth(cli rpclient.Client, mux clientd.Muxer) cronv3.Tasker {
 	return &healthPing{
 		cli: cli,
+		mux: mux,
 	}
 }
 
 type healthPing struct {
 	cli rpclient.Client
+	mux clientd.Muxer
 }
 
 func (hp *healthPing) Info() cronv3.TaskInfo {
@@ -28,5 +31,9 @@ func (hp *healthPing) Info() cronv3.TaskInfo {
 }
 
 func (hp *healthPing) Call(ctx context.Context) error {
+	if !hp.mux.State().Connected() {
+		return nil // 断线重连期间不发送心跳
+	}
+
 	return hp.cli.Ping(ctx)
 }
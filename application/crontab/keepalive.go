@@ -0,0 +1,157 @@
+package crontab
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/xmx/aegis-broker/application/business"
+	"github.com/xmx/aegis-broker/channel/serverd"
+	"github.com/xmx/aegis-broker/outbox"
+	"github.com/xmx/aegis-common/library/cronv3"
+	"github.com/xmx/aegis-control/datalayer/repository"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// NewKeepalive 将内存中的节点心跳时间批量写入数据库，并断开长时间没有心跳的节点通道。
+//
+// 写入失败的心跳时间下次执行时会以最新的值重新写入，w 应当使用 outbox.Unordered 直接无序写入数据库，
+// 某个节点写入失败不影响同一批次的其它节点，也不占用发件箱的容量。
+func NewKeepalive(tun serverd.Server, boot *business.BrokerConfig, repo repository.All, w outbox.Writer, interval time.Duration) cronv3.Tasker {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	return &keepalive{
+		tun:      tun,
+		boot:     boot,
+		repo:     repo,
+		w:        w,
+		interval: interval,
+		flushed:  make(map[bson.ObjectID]time.Time, 64),
+		kicking:  make(map[bson.ObjectID]struct{}, 8),
+	}
+}
+
+type keepalive struct {
+	tun      serverd.Server
+	boot     *business.BrokerConfig
+	repo     repository.All
+	w        outbox.Writer
+	interval time.Duration
+	mutex    sync.Mutex                  // 数据库不可用时单次执行可能很久，避免多次执行重叠
+	flushed  map[bson.ObjectID]time.Time // 会话 ID -> 已经写入数据库的心跳时间
+	kickMu   sync.Mutex
+	kicking  map[bson.ObjectID]struct{} // 正在断开的会话 ID
+}
+
+func (k *keepalive) Info() cronv3.TaskInfo {
+	return cronv3.TaskInfo{
+		Name:      "批量写入节点心跳",
+		Timeout:   time.Minute,
+		CronSched: cron.Every(k.interval),
+	}
+}
+
+func (k *keepalive) Call(ctx context.Context) error {
+	if !k.mutex.TryLock() {
+		return nil // 上一次还没有执行完毕
+	}
+	defer k.mutex.Unlock()
+
+	var timeout time.Duration
+	if boot, _ := k.boot.Load(ctx); boot != nil {
+		timeout = time.Duration(boot.Keepalive.Timeout)
+	}
+
+	const batch = 100
+
+	now := time.Now()
+	var errs []error
+	sessions := k.tun.Sessions()
+	alive := make(map[bson.ObjectID]struct{}, len(sessions))
+	pending := make(map[bson.ObjectID]time.Time, batch)
+	coll := k.repo.Agent().Collection().Name()
+	ops := make([]outbox.Op, 0, batch)
+	for _, sess := range sessions {
+		alive[sess.ID] = struct{}{}
+		id := sess.Peer.ID()
+		if timeout > 0 && now.Sub(sess.KeepaliveAt) > timeout {
+			k.disconnect(sess.ID, id)
+			continue
+		}
+
+		at := sess.KeepaliveAt
+		if !at.After(k.flushed[sess.ID]) || at.Equal(sess.ConnectAt) {
+			continue // 没有新的心跳
+		}
+		filter := bson.D{
+			{Key: "_id", Value: id},
+			{Key: "status", Value: true},
+			{Key: "session_id", Value: sess.ID},
+		}
+		update := bson.M{"$set": bson.M{"tunnel_stat.keepalive_at": at}}
+		ops = append(ops, outbox.UpdateOne(coll, filter, update))
+		pending[sess.ID] = at
+
+		if len(ops) < batch {
+			continue
+		}
+
+		if err := k.write(ctx, ops, pending); err != nil {
+			errs = append(errs, err)
+		}
+		ops = ops[:0]
+		clear(pending)
+	}
+	if err := k.write(ctx, ops, pending); err != nil {
+		errs = append(errs, err)
+	}
+
+	for sid := range k.flushed { // 清理已经下线的会话
+		if _, exists := alive[sid]; !exists {
+			delete(k.flushed, sid)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// disconnect 断开心跳超时的节点通道，会等待下线处理完毕，所以在后台执行，不能阻塞批量写入。
+// 同一个会话正在断开时不再重复断开。
+func (k *keepalive) disconnect(sid, agentID bson.ObjectID) {
+	k.kickMu.Lock()
+	_, exists := k.kicking[sid]
+	if !exists {
+		k.kicking[sid] = struct{}{}
+	}
+	k.kickMu.Unlock()
+	if exists {
+		return
+	}
+
+	go func() {
+		k.tun.Disconnect(agentID, serverd.ReasonKeepaliveTimeout, "心跳超时")
+
+		k.kickMu.Lock()
+		delete(k.kicking, sid)
+		k.kickMu.Unlock()
+	}()
+}
+
+func (k *keepalive) write(ctx context.Context, ops []outbox.Op, pending map[bson.ObjectID]time.Time) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	if err := k.w.Write(ctx, ops...); err != nil {
+		return err
+	}
+	for sid, at := range pending {
+		k.flushed[sid] = at
+	}
+
+	return nil
+}
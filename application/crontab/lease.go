@@ -0,0 +1,32 @@
+package crontab
+
+import (
+	"context"
+
+	"github.com/robfig/cron/v3"
+	"github.com/xmx/aegis-broker/application/business"
+	"github.com/xmx/aegis-common/library/cronv3"
+)
+
+func NewLease(lease *business.Lease) cronv3.Tasker {
+	return &leaseRenew{
+		lease: lease,
+	}
+}
+
+type leaseRenew struct {
+	lease *business.Lease
+}
+
+func (lr *leaseRenew) Info() cronv3.TaskInfo {
+	du := lr.lease.Interval()
+	return cronv3.TaskInfo{
+		Name:      "broker 租约续约",
+		Timeout:   du,
+		CronSched: cron.Every(du),
+	}
+}
+
+func (lr *leaseRenew) Call(ctx context.Context) error {
+	return lr.lease.Renew(ctx)
+}
@@ -0,0 +1,33 @@
+package crontab
+
+import (
+	"context"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/xmx/aegis-broker/outbox"
+	"github.com/xmx/aegis-common/library/cronv3"
+)
+
+// NewOutbox 定时重放发件箱中暂存的数据库写操作。
+func NewOutbox(ob *outbox.Outbox) cronv3.Tasker {
+	return &outboxTask{
+		ob: ob,
+	}
+}
+
+type outboxTask struct {
+	ob *outbox.Outbox
+}
+
+func (ot *outboxTask) Info() cronv3.TaskInfo {
+	return cronv3.TaskInfo{
+		Name:      "重放发件箱中的数据库写操作",
+		Timeout:   5 * time.Minute,
+		CronSched: cron.Every(5 * time.Second),
+	}
+}
+
+func (ot *outboxTask) Call(ctx context.Context) error {
+	return ot.ob.Replay(ctx)
+}
@@ -6,29 +6,34 @@ import (
 	"time"
 
 	"github.com/robfig/cron/v3"
+	"github.com/xmx/aegis-broker/channel/serverd"
+	"github.com/xmx/aegis-broker/outbox"
 	"github.com/xmx/aegis-common/library/cronv3"
 	"github.com/xmx/aegis-common/muxlink/muxconn"
 	"github.com/xmx/aegis-control/datalayer/repository"
-	"github.com/xmx/aegis-control/linkhub"
 	"go.mongodb.org/mongo-driver/v2/bson"
-	"go.mongodb.org/mongo-driver/v2/mongo"
-	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
-func NewTransmit(id bson.ObjectID, mux muxconn.Muxer, hub linkhub.Huber, repo repository.All) cronv3.Tasker {
+// NewTransmit 定时记录 broker 与节点通道的传输字节数。
+//
+// 传输字节数是累计值，下次执行会覆盖，写入失败直接丢弃即可。w 应当使用 outbox.Unordered 直接无序写入数据库，
+// 某个节点写入失败不影响同一批次的其它节点，也不占用发件箱的容量。
+func NewTransmit(id bson.ObjectID, mux muxconn.Muxer, tun serverd.Server, repo repository.All, w outbox.Writer) cronv3.Tasker {
 	return &transmit{
 		id:   id,
 		mux:  mux,
-		hub:  hub,
+		tun:  tun,
 		repo: repo,
+		w:    w,
 	}
 }
 
 type transmit struct {
 	id   bson.ObjectID
 	mux  muxconn.Muxer
-	hub  linkhub.Huber
+	tun  serverd.Server
 	repo repository.All
+	w    outbox.Writer
 }
 
 func (t *transmit) Info() cronv3.TaskInfo {
@@ -58,20 +63,21 @@ func (t *transmit) broker(ctx context.Context) error {
 		"tunnel_stat.transmit_bytes": tx,
 	}}
 
-	repo := t.repo.Broker()
-	_, err := repo.UpdateByID(ctx, t.id, update)
+	coll := t.repo.Broker().Collection().Name()
+	op := outbox.UpdateOne(coll, bson.M{"_id": t.id}, update)
 
-	return err
+	return t.w.Write(ctx, op)
 }
 
 func (t *transmit) agents(ctx context.Context) []error {
 	const batch = 100
 
 	var errs []error
-	mods := make([]mongo.WriteModel, 0, batch)
-	for _, p := range t.hub.Peers() {
-		id := p.ID()
-		mux := p.Muxer()
+	coll := t.repo.Agent().Collection().Name()
+	ops := make([]outbox.Op, 0, batch)
+	for _, sess := range t.tun.Sessions() {
+		id := sess.Peer.ID()
+		mux := sess.Peer.Muxer()
 		tx, rx := mux.Traffic() // 在 broker 端统计 agent 的传输数据，rx tx 要互换
 
 		update := bson.M{"$set": bson.M{
@@ -82,36 +88,22 @@ func (t *transmit) agents(ctx context.Context) []error {
 		filter := bson.D{
 			{Key: "_id", Value: id},
 			{Key: "status", Value: true},
+			{Key: "session_id", Value: sess.ID},
 		}
-		mod := mongo.NewUpdateOneModel().
-			SetFilter(filter).
-			SetUpdate(update)
-		mods = append(mods, mod)
+		ops = append(ops, outbox.UpdateOne(coll, filter, update))
 
-		if len(mods) < batch {
+		if len(ops) < batch {
 			continue
 		}
 
-		if err := t.bulkWrite(ctx, mods); err != nil {
+		if err := t.w.Write(ctx, ops...); err != nil {
 			errs = append(errs, err)
 		}
-		mods = mods[:0]
+		ops = ops[:0]
 	}
-	if err := t.bulkWrite(ctx, mods); err != nil {
+	if err := t.w.Write(ctx, ops...); err != nil {
 		errs = append(errs, err)
 	}
 
 	return errs
 }
-
-func (t *transmit) bulkWrite(ctx context.Context, mods []mongo.WriteModel) error {
-	if len(mods) == 0 {
-		return nil
-	}
-
-	opt := options.BulkWrite().SetOrdered(false)
-	repo := t.repo.Agent()
-	_, err := repo.BulkWrite(ctx, mods, opt)
-
-	return err
-}
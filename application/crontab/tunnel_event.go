@@ -0,0 +1,42 @@
+package crontab
+
+import (
+	"context"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/xmx/aegis-broker/application/business"
+	"github.com/xmx/aegis-broker/channel/clientd"
+	"github.com/xmx/aegis-common/library/cronv3"
+)
+
+// NewTunnelEvent 定时批量上报节点通道的上下线事件。
+//
+// 中心端通道断线重连期间不上报，事件暂存在队列中。
+func NewTunnelEvent(events *business.TunnelEvents, mux clientd.Muxer) cronv3.Tasker {
+	return &tunnelEvent{
+		events: events,
+		mux:    mux,
+	}
+}
+
+type tunnelEvent struct {
+	events *business.TunnelEvents
+	mux    clientd.Muxer
+}
+
+func (te *tunnelEvent) Info() cronv3.TaskInfo {
+	return cronv3.TaskInfo{
+		Name:      "上报节点通道事件",
+		Timeout:   30 * time.Second,
+		CronSched: cron.Every(2 * time.Second),
+	}
+}
+
+func (te *tunnelEvent) Call(ctx context.Context) error {
+	if !te.mux.State().Connected() {
+		return nil
+	}
+
+	return te.events.Flush(ctx)
+}
@@ -3,6 +3,7 @@ package restapi
 import (
 	"github.com/gorilla/websocket"
 	"github.com/xgfone/ship/v5"
+	"github.com/xmx/aegis-broker/channel/serverd"
 	"github.com/xmx/aegis-common/library/httpkit"
 	"github.com/xmx/aegis-common/muxlink/muxconn"
 	"github.com/xmx/aegis-common/muxlink/muxproto"
@@ -48,6 +49,10 @@ func (tnl *Tunnel) open(c *ship.Context) error {
 		return err
 	}
 
+	if stat := r.TLS; stat != nil {
+		mux = serverd.WithCertificates(mux, stat.PeerCertificates)
+	}
+
 	tnl.acpt.AcceptMUX(mux)
 	_ = mux.Close()
 
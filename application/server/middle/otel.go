@@ -1,27 +1,34 @@
 package middle
 
 import (
+	"net/http"
+
 	"github.com/xgfone/ship/v5"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func NewOtel() ship.Middleware {
-	return new(otelMiddle).middle
+// NewOtel 链路追踪中间件，name 为 tracer 的名字，用于区分 server RPC 与 agent RPC。
+func NewOtel(name string) ship.Middleware {
+	return (&otelMiddle{name: name}).middle
 }
 
-type otelMiddle struct{}
+type otelMiddle struct {
+	name string
+}
 
 func (om *otelMiddle) middle(h ship.Handler) ship.Handler {
-	tracer := otel.Tracer("aegis-server-http")
+	tracer := otel.Tracer(om.name)
 	return func(c *ship.Context) error {
 		req := c.Request()
 		parent := otel.GetTextMapPropagator(). // 解析上游 trace
 							Extract(req.Context(), propagation.HeaderCarrier(req.Header))
 
 		spanName := req.Method + " " + req.URL.Path
-		ctx, span := tracer.Start(parent, spanName)
+		ctx, span := tracer.Start(parent, spanName, trace.WithSpanKind(trace.SpanKindServer))
 		defer span.End()
 
 		span.SetAttributes(
@@ -38,6 +45,15 @@ func (om *otelMiddle) middle(h ship.Handler) ship.Handler {
 
 		c.SetRequest(newReq)
 
-		return h(c)
+		err := h(c)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else if code := c.StatusCode(); code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(code))
+		}
+		span.SetAttributes(attribute.Int("http.status_code", c.StatusCode()))
+
+		return err
 	}
 }
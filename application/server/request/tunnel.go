@@ -0,0 +1,37 @@
+package request
+
+import (
+	"github.com/xmx/aegis-control/datalayer/model"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// TunnelFilter 在线节点通道过滤条件，条件为空代表不过滤。
+type TunnelFilter struct {
+	Keyword string `json:"keyword" query:"keyword" validate:"lte=100"` // 模糊匹配节点 ID、机器码、主机名、IP 和地址
+	Goos    string `json:"goos"    query:"goos"    validate:"lte=20"`
+	Goarch  string `json:"goarch"  query:"goarch"  validate:"lte=20"`
+	Semver  string `json:"semver"  query:"semver"  validate:"lte=50"`
+	Library string `json:"library" query:"library" validate:"lte=50"` // 通道底层库名
+}
+
+// TunnelPage 在线节点通道分页查询条件。
+type TunnelPage struct {
+	Page int64 `query:"page" validate:"gte=0"`
+	Size int64 `query:"size" validate:"gte=0,lte=1000"`
+	TunnelFilter
+}
+
+// TunnelKick 强制节点下线。
+type TunnelKick struct {
+	ID     bson.ObjectID  `json:"id"     validate:"required"`
+	Reason string         `json:"reason" validate:"lte=200"`
+	Ban    model.Duration `json:"ban"    validate:"gte=0"` // 禁止再次上线的时长，0 代表不禁止。
+}
+
+// TunnelKicks 批量强制符合条件的节点下线，条件全部为空时必须指定 all 才会断开所有节点。
+type TunnelKicks struct {
+	TunnelFilter
+	All    bool           `json:"all"` // 过滤条件全部为空时，确认断开所有节点。
+	Reason string         `json:"reason" validate:"lte=200"`
+	Ban    model.Duration `json:"ban"    validate:"gte=0"`
+}
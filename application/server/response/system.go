@@ -1,11 +1,21 @@
 package response
 
 import (
+	"github.com/xmx/aegis-broker/channel/clientd"
 	"github.com/xmx/aegis-broker/config"
-	"github.com/xmx/aegis-control/datalayer/model"
 )
 
 type SystemConfig struct {
-	Hide *config.Config     `json:"hide"`
-	Boot model.BrokerConfig `json:"boot"`
+	Hide *config.Config `json:"hide"`
+	Boot *config.Boot   `json:"boot"`
+}
+
+type SystemReload struct {
+	Changed bool `json:"changed"` // 配置是否有变化
+}
+
+// SystemUpstream broker 连接中心端的通道状态。
+type SystemUpstream struct {
+	State     clientd.LinkState      `json:"state"`     // 连接状态与当前使用的接入点
+	Endpoints []clientd.EndpointStat `json:"endpoints"` // 各个接入点的连接统计与健康评分
 }
@@ -0,0 +1,7 @@
+package response
+
+import "go.mongodb.org/mongo-driver/v2/bson"
+
+type TunnelKick struct {
+	Kicked []bson.ObjectID `json:"kicked"` // 被断开的在线节点
+}
@@ -0,0 +1,98 @@
+package restapi
+
+import (
+	"net/http"
+
+	"github.com/xgfone/ship/v5"
+	"github.com/xmx/aegis-broker/application/server/service"
+	"github.com/xmx/aegis-broker/config"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func NewBandwidth(svc *service.Bandwidth) *Bandwidth {
+	return &Bandwidth{svc: svc}
+}
+
+// Bandwidth 通道带宽策略，单位均为 KiB/s，0 代表不限制。
+type Bandwidth struct {
+	svc *service.Bandwidth
+}
+
+func (bdw *Bandwidth) RegisterRoute(r *ship.RouteGroupBuilder) error {
+	r.Route("/bandwidth/broker").GET(bdw.broker).PUT(bdw.setBroker)
+	r.Route("/bandwidth/agents").GET(bdw.agents)
+	r.Route("/bandwidth/agent").GET(bdw.agent).PUT(bdw.setAgent)
+	return nil
+}
+
+func (bdw *Bandwidth) broker(c *ship.Context) error {
+	ctx := c.Request().Context()
+	ret, err := bdw.svc.Broker(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ret)
+}
+
+// setBroker 修改 broker 连接中心端的通道带宽上限，以及节点通道默认的带宽上限。
+func (bdw *Bandwidth) setBroker(c *ship.Context) error {
+	req := new(config.BootBandwidth)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	ret, err := bdw.svc.SetBroker(ctx, *req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ret)
+}
+
+// agents 当前 broker 上所有在线节点的带宽策略。
+func (bdw *Bandwidth) agents(c *ship.Context) error {
+	ctx := c.Request().Context()
+	ret, err := bdw.svc.Agents(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ret)
+}
+
+func (bdw *Bandwidth) agent(c *ship.Context) error {
+	id, err := bson.ObjectIDFromHex(c.Query("id"))
+	if err != nil {
+		return ship.ErrBadRequest.Newf("节点 ID 格式错误")
+	}
+
+	ctx := c.Request().Context()
+	ret, err := bdw.svc.Agent(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ret)
+}
+
+// setAgent 修改节点的带宽上限，limit 为 null 代表恢复使用默认值。
+func (bdw *Bandwidth) setAgent(c *ship.Context) error {
+	type requestData struct {
+		ID    bson.ObjectID `json:"id"    validate:"required"`
+		Limit *int64        `json:"limit" validate:"omitempty,gte=0"`
+	}
+	req := new(requestData)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	ret, err := bdw.svc.SetAgent(ctx, req.ID, req.Limit)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ret)
+}
@@ -13,6 +13,10 @@ import (
 	"github.com/xmx/aegis-broker/channel/rpclient"
 	"github.com/xmx/aegis-common/muxlink/muxproto"
 	"github.com/xmx/aegis-common/wsocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func NewReverse(cli rpclient.Client) *Reverse {
@@ -62,6 +66,9 @@ func (rvs *Reverse) serve(c *ship.Context) error {
 		pth += "/"
 	}
 
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(attribute.String("aegis.agent.id", id))
+
 	destURL := muxproto.ToAgentURL(id, pth)
 	destURL.RawQuery = reqURL.RawQuery
 
@@ -91,7 +98,9 @@ func (rvs *Reverse) serveWebsocket(c *ship.Context, destURL *url.URL) {
 
 	destURL.Scheme = "ws"
 	strURL := destURL.String()
-	srv, _, err := rvs.wsd.DialContext(ctx, strURL, nil)
+	header := make(http.Header, 4)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+	srv, _, err := rvs.wsd.DialContext(ctx, strURL, header)
 	if err != nil {
 		c.Errorf("连接 agent 后端失败", "url", strURL, "error", err)
 		_ = rvs.writeClose(cli, err)
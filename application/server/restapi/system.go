@@ -2,16 +2,16 @@ package restapi
 
 import (
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/xgfone/ship/v5"
+	"github.com/xmx/aegis-broker/application/server/response"
 	"github.com/xmx/aegis-broker/application/server/service"
-	"github.com/xmx/aegis-common/muxlink/muxconn"
-	"golang.org/x/time/rate"
+	"github.com/xmx/aegis-broker/channel/clientd"
+	"github.com/xmx/aegis-control/datalayer/model"
 )
 
-func NewSystem(mux muxconn.Muxer, svc *service.System) *System {
+func NewSystem(mux clientd.Muxer, svc *service.System) *System {
 	return &System{
 		mux: mux,
 		svc: svc,
@@ -19,24 +19,43 @@ func NewSystem(mux muxconn.Muxer, svc *service.System) *System {
 }
 
 type System struct {
-	mux muxconn.Muxer
+	mux clientd.Muxer
 	svc *service.System
 }
 
 func (syt *System) RegisterRoute(r *ship.RouteGroupBuilder) error {
 	r.Route("/system/config").GET(syt.config)
+	r.Route("/system/reload").POST(syt.reload)
 	r.Route("/system/ping").GET(syt.ping)
 	r.Route("/system/exit").GET(syt.exit)
 	r.Route("/system/upgrade").GET(syt.upgrade)
-	r.Route("/system/download").GET(syt.download)
-	r.Route("/system/limit").GET(syt.limit)
-	r.Route("/system/setlimit").GET(syt.setlimit)
+	r.Route("/system/upgrade/status").GET(syt.upgradeStatus)
+	r.Route("/system/drain").POST(syt.drain)
+	r.Route("/system/drain/status").GET(syt.drainStatus)
+	r.Route("/system/drain/cancel").POST(syt.drainCancel)
 	r.Route("/system/streams").GET(syt.streams)
+	r.Route("/system/upstream").GET(syt.upstream)
 	return nil
 }
 
 func (syt *System) config(c *ship.Context) error {
-	ret := syt.svc.Config()
+	ctx := c.Request().Context()
+	ret, err := syt.svc.Config(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ret)
+}
+
+// reload 通知 broker 重新加载配置。
+func (syt *System) reload(c *ship.Context) error {
+	ctx := c.Request().Context()
+	ret, err := syt.svc.Reload(ctx)
+	if err != nil {
+		return err
+	}
+
 	return c.JSON(http.StatusOK, ret)
 }
 
@@ -51,27 +70,54 @@ func (syt *System) exit(*ship.Context) error {
 // upgrade 通知 broker 升级。
 func (syt *System) upgrade(c *ship.Context) error {
 	ctx := c.Request().Context()
-	_, err := syt.svc.Upgrade(ctx)
+	ret, err := syt.svc.Upgrade(ctx)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return c.JSON(http.StatusOK, ret)
 }
 
-func (syt *System) download(c *ship.Context) error {
-	return c.Attachment("D:\\Users\\Administrator\\Downloads\\30g.bin", "")
+// upgradeStatus 查询升级进度。
+func (syt *System) upgradeStatus(c *ship.Context) error {
+	ret := syt.svc.UpgradeStatus()
+	return c.JSON(http.StatusOK, ret)
 }
 
-func (syt *System) limit(c *ship.Context) error {
-	limit := syt.mux.Limit()
+// drain 排空 broker：拒绝新节点上线，通知在线节点迁移到其它 broker，
+// 等待节点下线（超时后强制下线）后退出。
+func (syt *System) drain(c *ship.Context) error {
+	type requestData struct {
+		Timeout model.Duration `json:"timeout" validate:"gte=0"` // 等待节点下线的最长时间，默认 5m。
+	}
+	req := new(requestData)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
 
-	return c.JSON(http.StatusOK, map[string]any{"limit": limit})
+	ctx := c.Request().Context()
+	ret, err := syt.svc.Drain(ctx, time.Duration(req.Timeout))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ret)
 }
 
-func (syt *System) setlimit(c *ship.Context) error {
-	str := c.Query("limit")
-	num, _ := strconv.ParseInt(str, 10, 64)
-	syt.mux.SetLimit(rate.Limit(num * 1024))
+// drainStatus 查询排空进度。
+func (syt *System) drainStatus(c *ship.Context) error {
+	ret := syt.svc.DrainStatus()
+	return c.JSON(http.StatusOK, ret)
+}
 
-	return c.NoContent(http.StatusNoContent)
+// drainCancel 取消排空，恢复接受节点上线。
+func (syt *System) drainCancel(c *ship.Context) error {
+	ret, err := syt.svc.DrainCancel()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ret)
 }
 
 func (syt *System) streams(c *ship.Context) error {
@@ -79,3 +125,13 @@ func (syt *System) streams(c *ship.Context) error {
 
 	return c.JSON(http.StatusOK, map[string]any{"history": history, "active": active})
 }
+
+// upstream broker 连接中心端的通道状态，包括断线重连的次数与原因、各个接入点的健康评分。
+func (syt *System) upstream(c *ship.Context) error {
+	ret := &response.SystemUpstream{
+		State:     syt.mux.State(),
+		Endpoints: syt.mux.Endpoints(),
+	}
+
+	return c.JSON(http.StatusOK, ret)
+}
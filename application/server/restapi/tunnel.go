@@ -0,0 +1,157 @@
+package restapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xgfone/ship/v5"
+	"github.com/xmx/aegis-broker/application/server/request"
+	"github.com/xmx/aegis-broker/application/server/service"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func NewTunnel(svc *service.Tunnel) *Tunnel {
+	return &Tunnel{svc: svc}
+}
+
+// Tunnel 当前 broker 上节点通道的运行时状态，用于排查单个节点的连接问题。
+type Tunnel struct {
+	svc *service.Tunnel
+}
+
+func (tnl *Tunnel) RegisterRoute(r *ship.RouteGroupBuilder) error {
+	r.Route("/tunnels").GET(tnl.page)
+	r.Route("/tunnel").GET(tnl.detail)
+	r.Route("/tunnel/kick").POST(tnl.kick)
+	r.Route("/tunnel/kicks").POST(tnl.kicks)
+	r.Route("/tunnel/unban").POST(tnl.unban)
+	r.Route("/tunnel/events").GET(tnl.events)
+	return nil
+}
+
+func (tnl *Tunnel) page(c *ship.Context) error {
+	req := new(request.TunnelPage)
+	if err := c.BindQuery(req); err != nil {
+		return err
+	}
+	ret := tnl.svc.Page(req)
+
+	return c.JSON(http.StatusOK, ret)
+}
+
+func (tnl *Tunnel) detail(c *ship.Context) error {
+	id, err := bson.ObjectIDFromHex(c.Query("id"))
+	if err != nil {
+		return ship.ErrBadRequest.Newf("节点 ID 格式错误")
+	}
+
+	ret, err := tnl.svc.Detail(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ret)
+}
+
+// kick 强制节点下线，可选地在一段时间内禁止其再次上线。
+func (tnl *Tunnel) kick(c *ship.Context) error {
+	req := new(request.TunnelKick)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	ret, err := tnl.svc.Kick(req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ret)
+}
+
+// kicks 批量强制符合条件的节点下线。
+func (tnl *Tunnel) kicks(c *ship.Context) error {
+	req := new(request.TunnelKicks)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	ret, err := tnl.svc.Kicks(req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ret)
+}
+
+func (tnl *Tunnel) unban(c *ship.Context) error {
+	id, err := bson.ObjectIDFromHex(c.Query("id"))
+	if err != nil {
+		return ship.ErrBadRequest.Newf("节点 ID 格式错误")
+	}
+	if err = tnl.svc.Unban(id); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// events 以 SSE（text/event-stream）实时推送节点上下线事件。
+//
+// 事件 ID 为 boot_id-seq，断线重连时通过 Last-Event-ID 请求头或 since 参数补发之后的事件，
+// broker 重启过（boot_id 不一致）则从头补发。
+func (tnl *Tunnel) events(c *ship.Context) error {
+	since := c.GetReqHeader("Last-Event-ID", c.Query("since"))
+	bootID, seq := parseTunnelEventID(since)
+
+	ctx := c.Request().Context()
+	events := tnl.svc.Subscribe(ctx, bootID, seq)
+
+	header := c.RespHeader()
+	header.Set(ship.HeaderContentType, "text/event-stream")
+	header.Set(ship.HeaderCacheControl, "no-cache")
+	header.Set(ship.HeaderConnection, "keep-alive")
+	res := c.Response()
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if _, err := res.WriteString(": ping\n\n"); err != nil {
+				return nil
+			}
+		case evt, ok := <-events:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(evt)
+			if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintf(res, "id: %s-%d\nevent: %s\ndata: %s\n\n", evt.BootID.Hex(), evt.Seq, evt.Type, data); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
+
+// parseTunnelEventID 解析 boot_id-seq 格式的事件 ID，只有序号时 boot_id 为零值。
+func parseTunnelEventID(id string) (bson.ObjectID, uint64) {
+	var bootID bson.ObjectID
+	if hex, num, found := strings.Cut(id, "-"); found {
+		bootID, _ = bson.ObjectIDFromHex(hex)
+		id = num
+	}
+	seq, _ := strconv.ParseUint(id, 10, 64)
+
+	return bootID, seq
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/xgfone/ship/v5"
+	"github.com/xmx/aegis-broker/application/business"
+	"github.com/xmx/aegis-broker/config"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func NewBandwidth(bw *business.Bandwidth, log *slog.Logger) *Bandwidth {
+	return &Bandwidth{
+		bw:  bw,
+		log: log,
+	}
+}
+
+type Bandwidth struct {
+	bw  *business.Bandwidth
+	log *slog.Logger
+}
+
+func (bdw *Bandwidth) Broker(ctx context.Context) (*business.BrokerBandwidth, error) {
+	return bdw.bw.Broker(ctx)
+}
+
+// SetBroker 修改 broker 的带宽策略，保存后立即生效。
+func (bdw *Bandwidth) SetBroker(ctx context.Context, cfg config.BootBandwidth) (*business.BrokerBandwidth, error) {
+	if err := bdw.bw.SetBroker(ctx, cfg); err != nil {
+		bdw.log.Warn("修改 broker 带宽策略出错", "error", err)
+		return nil, err
+	}
+
+	return bdw.bw.Broker(ctx)
+}
+
+func (bdw *Bandwidth) Agents(ctx context.Context) ([]*business.AgentBandwidth, error) {
+	return bdw.bw.Agents(ctx)
+}
+
+func (bdw *Bandwidth) Agent(ctx context.Context, id bson.ObjectID) (*business.AgentBandwidth, error) {
+	ret, err := bdw.bw.Agent(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ship.ErrNotFound.Newf("节点不存在")
+	}
+
+	return ret, err
+}
+
+// SetAgent 修改节点的带宽上限，limit 为空代表恢复使用默认值。
+func (bdw *Bandwidth) SetAgent(ctx context.Context, id bson.ObjectID, limit *int64) (*business.AgentBandwidth, error) {
+	ret, err := bdw.bw.SetAgent(ctx, id, limit)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ship.ErrNotFound.Newf("节点不存在")
+	}
+
+	return ret, err
+}
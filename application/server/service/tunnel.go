@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xgfone/ship/v5"
+	"github.com/xmx/aegis-broker/application/business"
+	"github.com/xmx/aegis-broker/application/server/request"
+	"github.com/xmx/aegis-broker/application/server/response"
+	"github.com/xmx/aegis-control/datalayer/repository"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func NewTunnel(tnl *business.Tunnel, events *business.TunnelEvents, log *slog.Logger) *Tunnel {
+	return &Tunnel{
+		tnl:    tnl,
+		events: events,
+		log:    log,
+	}
+}
+
+type Tunnel struct {
+	tnl    *business.Tunnel
+	events *business.TunnelEvents
+	log    *slog.Logger
+}
+
+// Page 分页查询当前 broker 上的在线节点通道。
+func (tnl *Tunnel) Page(req *request.TunnelPage) *repository.Pages[business.TunnelStat, []*business.TunnelStat] {
+	stats := tnl.tnl.Stats()
+	records := make([]*business.TunnelStat, 0, len(stats))
+	for _, stat := range stats {
+		if matchTunnel(stat, req.TunnelFilter) {
+			records = append(records, stat)
+		}
+	}
+
+	cnt := int64(len(records))
+	page, size, skip := repository.NewPageHelper(req.Page, req.Size).LPR(cnt)
+	end := min(skip+size, cnt)
+	ret := &repository.Pages[business.TunnelStat, []*business.TunnelStat]{
+		Page:    page,
+		Size:    size,
+		Count:   cnt,
+		Records: records[min(skip, cnt):end],
+	}
+
+	return ret
+}
+
+// Detail 查询节点的通道状态。
+func (tnl *Tunnel) Detail(id bson.ObjectID) (*business.TunnelStat, error) {
+	if ret := tnl.tnl.Stat(id); ret != nil {
+		return ret, nil
+	}
+
+	return nil, ship.ErrNotFound.Newf("节点不在线")
+}
+
+// Kick 强制节点下线，节点不在线且不需要封禁时返回 404。
+func (tnl *Tunnel) Kick(req *request.TunnelKick) (*response.TunnelKick, error) {
+	ban := time.Duration(req.Ban)
+	online, err := tnl.tnl.Kick(req.ID, req.Reason, ban)
+	if err != nil {
+		tnl.log.Error("封禁节点出错", "agent_id", req.ID, "reason", req.Reason, "ban", ban, "error", err)
+		return nil, err
+	}
+	tnl.log.Warn("强制节点下线", "agent_id", req.ID, "reason", req.Reason, "ban", ban, "online", online)
+	if !online && ban <= 0 {
+		return nil, ship.ErrNotFound.Newf("节点不在线")
+	}
+
+	ret := &response.TunnelKick{Kicked: []bson.ObjectID{}}
+	if online {
+		ret.Kicked = append(ret.Kicked, req.ID)
+	}
+
+	return ret, nil
+}
+
+// Kicks 批量强制符合条件的节点下线，并发断开并等待下线处理完毕。
+//
+// 过滤条件全部为空时会匹配所有节点，为防止误操作，必须同时指定 all。
+func (tnl *Tunnel) Kicks(req *request.TunnelKicks) (*response.TunnelKick, error) {
+	if req.TunnelFilter == (request.TunnelFilter{}) && !req.All {
+		return nil, ship.ErrBadRequest.Newf("过滤条件为空时必须指定 all 才能断开所有节点")
+	}
+
+	const concurrency = 32
+
+	ban := time.Duration(req.Ban)
+	ret := &response.TunnelKick{Kicked: []bson.ObjectID{}}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, concurrency)
+	for _, stat := range tnl.tnl.Stats() {
+		if !matchTunnel(stat, req.TunnelFilter) {
+			continue
+		}
+		limit <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-limit }()
+			online, err := tnl.tnl.Kick(stat.ID, req.Reason, ban)
+			if err != nil {
+				tnl.log.Error("封禁节点出错", "agent_id", stat.ID, "error", err)
+			}
+			if online {
+				mutex.Lock()
+				ret.Kicked = append(ret.Kicked, stat.ID)
+				mutex.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	tnl.log.Warn("批量强制节点下线", "filter", req.TunnelFilter, "all", req.All, "reason", req.Reason, "ban", ban, "count", len(ret.Kicked))
+
+	return ret, nil
+}
+
+// Unban 解除节点的上线封禁。
+func (tnl *Tunnel) Unban(id bson.ObjectID) error {
+	return tnl.tnl.Unban(id)
+}
+
+// Subscribe 订阅节点上下线事件，先补发序号大于 since 的历史事件，再推送实时事件。
+//
+// bootID 不为零值且与本进程的启动 ID 不一致时，说明 broker 重启过，序号已经从头开始，补发全部历史事件。
+// 返回的通道在 ctx 取消后关闭。
+func (tnl *Tunnel) Subscribe(ctx context.Context, bootID bson.ObjectID, since uint64) <-chan *business.TunnelEvent {
+	if !bootID.IsZero() && bootID != tnl.events.BootID() {
+		since = 0
+	}
+
+	// 先订阅再查询历史事件，避免两者之间产生的事件丢失，重复的事件根据序号去重。
+	live, cancel := tnl.events.Subscribe(256)
+	history := tnl.events.Since(since)
+
+	out := make(chan *business.TunnelEvent)
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		last := since
+		send := func(evt *business.TunnelEvent) bool {
+			if evt.Seq <= last {
+				return true
+			}
+			// 订阅者消费太慢时实时事件可能被跳过，从历史事件中补齐。
+			if evt.Seq > last+1 {
+				for _, miss := range tnl.events.Since(last) {
+					if miss.Seq >= evt.Seq {
+						break
+					}
+					select {
+					case out <- miss:
+						last = miss.Seq
+					case <-ctx.Done():
+						return false
+					}
+				}
+			}
+			select {
+			case out <- evt:
+				last = evt.Seq
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, evt := range history {
+			if !send(evt) {
+				return
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case evt := <-live:
+				if !send(evt) {
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+func matchTunnel(stat *business.TunnelStat, req request.TunnelFilter) bool {
+	if req.Goos != "" && stat.Goos != req.Goos {
+		return false
+	}
+	if req.Goarch != "" && stat.Goarch != req.Goarch {
+		return false
+	}
+	if req.Semver != "" && stat.Semver != req.Semver {
+		return false
+	}
+	if req.Library != "" && stat.Library.Name != req.Library {
+		return false
+	}
+
+	kw := req.Keyword
+	if kw == "" {
+		return true
+	}
+	fields := []string{
+		stat.ID.Hex(), stat.MachineID, stat.Hostname, stat.Inet,
+		stat.LocalAddr, stat.RemoteAddr,
+	}
+	for _, field := range fields {
+		if strings.Contains(field, kw) {
+			return true
+		}
+	}
+
+	return false
+}
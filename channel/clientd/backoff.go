@@ -0,0 +1,44 @@
+package clientd
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff 断线重连的指数退避策略。
+//
+// 第 n 次重试的等待时长在 [0, min(Max, Min*2^n)] 之间随机（full jitter），
+// 避免大量 broker 同时重启后步调一致地重连中心端。
+type Backoff struct {
+	Min    time.Duration // 首次重试的最长等待时长，默认 1s。
+	Max    time.Duration // 等待时长的上限，默认 1m。
+	Stable time.Duration // 通道保持连接超过该时长视为稳定，断线后从头开始退避，默认 1m。
+}
+
+func (b Backoff) duration(attempt int) time.Duration {
+	low, high := b.Min, b.Max
+	if low <= 0 {
+		low = time.Second
+	}
+	if high <= 0 {
+		high = time.Minute
+	}
+	high = max(low, high)
+
+	ceil := high
+	if attempt < 32 {
+		if d := low << attempt; d > 0 && d < high {
+			ceil = d
+		}
+	}
+
+	return rand.N(ceil) + 1
+}
+
+func (b Backoff) stable() time.Duration {
+	if d := b.Stable; d > 0 {
+		return d
+	}
+
+	return time.Minute
+}
@@ -2,12 +2,15 @@ package clientd
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"net/http"
 	"os"
 	"runtime"
+	"sync/atomic"
 	"time"
 
+	"github.com/xmx/aegis-broker/channel/internal/graceful"
 	"github.com/xmx/aegis-common/muxlink/muxconn"
 	"github.com/xmx/aegis-common/muxlink/muxtool"
 )
@@ -16,9 +19,29 @@ type Options struct {
 	Secret  string
 	Semver  string
 	Handler http.Handler
+	Backoff Backoff // 断线重连的退避策略。
 }
 
-func Open(cfg muxconn.DialConfig, opt Options) (muxconn.Muxer, *AuthConfig, error) {
+// Muxer 连接中心端的通道，断线后会自动重连。
+type Muxer interface {
+	muxconn.Muxer
+
+	// Shutdown 优雅关闭：不再处理新的请求，等待正在处理的请求完成后断开通道，不再重连。
+	// ctx 超时后直接断开通道。
+	Shutdown(ctx context.Context) error
+
+	// State 通道的连接状态。
+	State() LinkState
+
+	// OnStateChange 注册连接状态变化的回调，例如：重连成功后上报断线期间暂存的数据。
+	// 回调会阻塞状态的变化，耗时操作要放在协程中执行。
+	OnStateChange(fn func(LinkState))
+
+	// Endpoints 各个接入点（地址 + 协议）的连接统计与健康评分。
+	Endpoints() []EndpointStat
+}
+
+func Open(cfg muxconn.DialConfig, opt Options) (Muxer, *AuthConfig, error) {
 	if cfg.Context == nil {
 		cfg.Context = context.Background()
 	}
@@ -37,10 +60,12 @@ func Open(cfg muxconn.DialConfig, opt Options) (muxconn.Muxer, *AuthConfig, erro
 
 	mux := new(muxInstance)
 	cli := &brokerClient{
-		cfg:  cfg,
-		opts: opt,
-		mux:  mux,
-		req:  req,
+		cfg:       cfg,
+		opts:      opt,
+		mux:       mux,
+		req:       req,
+		state:     newLinkState(),
+		endpoints: newEndpoints(cfg.Addresses, cfg.Protocols),
 	}
 
 	mc, auth, err := cli.openLoop()
@@ -51,14 +76,43 @@ func Open(cfg muxconn.DialConfig, opt Options) (muxconn.Muxer, *AuthConfig, erro
 
 	go cli.serveHTTP()
 
-	return mux, auth, nil
+	return &tunnel{muxInstance: mux, cli: cli}, auth, nil
+}
+
+type tunnel struct {
+	*muxInstance
+	cli *brokerClient
+}
+
+func (t *tunnel) Shutdown(ctx context.Context) error {
+	return t.cli.shutdown(ctx)
+}
+
+func (t *tunnel) State() LinkState {
+	return t.cli.state.load()
+}
+
+func (t *tunnel) OnStateChange(fn func(LinkState)) {
+	t.cli.state.watch(fn)
+}
+
+func (t *tunnel) Endpoints() []EndpointStat {
+	return t.cli.endpoints.stats()
 }
 
 type brokerClient struct {
-	cfg  muxconn.DialConfig
-	opts Options
-	mux  *muxInstance
-	req  *authRequest
+	cfg       muxconn.DialConfig
+	opts      Options
+	mux       *muxInstance
+	req       *authRequest
+	srv       atomic.Pointer[http.Server]
+	closed    atomic.Bool
+	state     *linkState
+	endpoints *endpoints
+
+	// attempt 连续重连失败的次数，用于计算退避时长，通道稳定连接一段时间后才清零，
+	// 避免通道频繁闪断时每次都从最短的等待时长开始重连。
+	attempt int
 }
 
 // openLoop 连接服务端直至成功或遇到不可重试的错误。
@@ -67,19 +121,29 @@ func (bc *brokerClient) openLoop() (muxconn.Muxer, *AuthConfig, error) {
 	for {
 		tires++
 
-		attrs := []any{"tires", tires}
-		if mux, cfg, err := bc.open(); err != nil {
-			attrs = append(attrs, "error", err)
-		} else {
+		attrs := []any{"tires", tires, "attempt", bc.attempt}
+		mux, cfg, err := bc.open()
+		if err == nil {
 			bc.log().Info("通道连接成功", attrs...)
+			bc.state.connected()
 			return mux, cfg, nil
 		}
-
-		du := bc.retryInterval(tires)
+		attrs = append(attrs, "error", err)
+		bc.state.failed(err)
+
+		du := bc.opts.Backoff.duration(bc.attempt)
+		bc.attempt++
+		if ae := (*AuthError)(nil); errors.As(err, &ae) {
+			if ae.Fatal() {
+				bc.log().Error("通道连接遇到不可重试的错误", attrs...)
+				return nil, nil, err
+			}
+			du = max(du, ae.RetryAfter) // 遵从中心端的重试建议
+		}
 		attrs = append(attrs, "sleep", du)
 		bc.log().Warn("通道连接失败，稍后重试", attrs...)
 
-		if err := bc.sleep(du); err != nil {
+		if err = bc.sleep(du); err != nil {
 			attrs = append(attrs, "final_error", err)
 			bc.log().Error("通道连接遇到不可重试的错误", attrs...)
 			return nil, nil, err
@@ -87,9 +151,49 @@ func (bc *brokerClient) openLoop() (muxconn.Muxer, *AuthConfig, error) {
 	}
 }
 
-//goland:noinspection GoUnhandledErrorResult
+// open 按照健康评分依次尝试各个接入点，直到有一个连接并认证成功。
+//
+// 收到中心端的认证响应（AuthError）说明已经连上了中心端，换接入点也是同样的结果，直接返回，
+// 由 openLoop 按照退避时间或者中心端的重试建议等待后重试。
 func (bc *brokerClient) open() (muxconn.Muxer, *AuthConfig, error) {
-	mux, err := muxconn.Open(bc.cfg)
+	var errs []error
+	for _, ep := range bc.endpoints.candidates() {
+		attrs := []any{"addr", ep.address, "proto", ep.protocol}
+		start := time.Now()
+		mux, cfg, err := bc.openEndpoint(ep)
+		if err == nil {
+			latency := time.Since(start)
+			bc.endpoints.succeeded(ep, latency)
+			bc.state.update(func(s *LinkState) {
+				s.Address, s.Protocol = ep.address, ep.protocol
+			})
+			attrs = append(attrs, "latency", latency)
+			bc.log().Info("中心端接入点连接成功", attrs...)
+			return mux, cfg, nil
+		}
+
+		attrs = append(attrs, "error", err)
+		if ae := (*AuthError)(nil); errors.As(err, &ae) {
+			bc.log().Warn("中心端拒绝了通道上线", attrs...)
+			return nil, nil, err
+		}
+		bc.endpoints.failed(ep, err)
+		bc.log().Warn("中心端接入点连接失败", attrs...)
+		errs = append(errs, err)
+		if cerr := bc.cfg.Context.Err(); cerr != nil {
+			return nil, nil, cerr
+		}
+	}
+
+	return nil, nil, errors.Join(errs...)
+}
+
+//goland:noinspection GoUnhandledErrorResult
+func (bc *brokerClient) openEndpoint(ep *endpoint) (muxconn.Muxer, *AuthConfig, error) {
+	cfg := bc.cfg
+	cfg.Addresses = []string{ep.address}
+	cfg.Protocols = []string{ep.protocol}
+	mux, err := muxconn.Open(cfg)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -138,12 +242,23 @@ func (bc *brokerClient) serveHTTP() {
 
 	for {
 		srv := &http.Server{Handler: h}
-		err := srv.Serve(bc.mux)
-		bc.log().Warn("通道断开连接了", "error", err)
+		bc.srv.Store(srv)
+		err := srv.Serve(graceful.NewListener(bc.mux))
+		if bc.closed.Load() {
+			bc.log().Warn("通道已关闭", "error", err)
+			break
+		}
+		bc.log().Warn("通道断开连接了，broker 继续服务节点并尝试重连", "error", err)
+		if time.Since(bc.state.load().ConnectedAt) >= bc.opts.Backoff.stable() {
+			bc.attempt = 0
+		}
+		bc.state.disconnected(err)
+		bc.endpoints.disconnected()
 
 		_ = bc.mux.Close() // 重连前确保关闭上一个连接
 		mc, _, err1 := bc.openLoop()
 		if err1 != nil {
+			bc.state.closed()
 			break
 		}
 
@@ -151,6 +266,21 @@ func (bc *brokerClient) serveHTTP() {
 	}
 }
 
+// shutdown 等待正在处理的请求完成后断开通道。
+//
+//goland:noinspection GoUnhandledErrorResult
+func (bc *brokerClient) shutdown(ctx context.Context) error {
+	bc.closed.Store(true)
+	defer bc.mux.Close()
+	defer bc.state.closed()
+
+	if srv := bc.srv.Load(); srv != nil {
+		return srv.Shutdown(ctx)
+	}
+
+	return nil
+}
+
 func (bc *brokerClient) log() *slog.Logger {
 	if l := bc.cfg.Logger; l != nil {
 		return l
@@ -172,18 +302,6 @@ func (bc *brokerClient) perContext() (context.Context, context.CancelFunc) {
 	return context.WithTimeout(bc.cfg.Context, d)
 }
 
-func (bc *brokerClient) retryInterval(tires int) time.Duration {
-	if tires <= 100 {
-		return 3 * time.Second
-	} else if tires <= 300 {
-		return 10 * time.Second
-	} else if tires <= 500 {
-		return 30 * time.Second
-	}
-
-	return time.Minute
-}
-
 func (bc *brokerClient) sleep(d time.Duration) error {
 	ctx := bc.cfg.Context
 	timer := time.NewTimer(d)
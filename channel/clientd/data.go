@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"sync/atomic"
+	"time"
 
 	"github.com/xmx/aegis-common/muxlink/muxconn"
 	"golang.org/x/time/rate"
@@ -25,9 +26,10 @@ type authRequest struct {
 }
 
 type authResponse struct {
-	Code    int         `json:"code"`    // 状态码
-	Message string      `json:"message"` // 错误信息
-	Config  *AuthConfig `json:"config"`
+	Code       int         `json:"code"`                 // 状态码
+	Message    string      `json:"message"`              // 错误信息
+	RetryAfter int         `json:"retry_after,omitzero"` // 中心端建议多少秒后再重试
+	Config     *AuthConfig `json:"config"`
 }
 
 type AuthConfig struct {
@@ -40,11 +42,43 @@ func (ar authResponse) checkError() error {
 		return nil
 	}
 
-	return fmt.Errorf("通道上线失败 %d: %s", ar.Code, ar.Message)
+	return &AuthError{
+		Code:       code,
+		Message:    ar.Message,
+		RetryAfter: time.Duration(ar.RetryAfter) * time.Second,
+	}
+}
+
+// AuthError 中心端拒绝通道上线。
+type AuthError struct {
+	Code       int
+	Message    string
+	RetryAfter time.Duration // 中心端建议的重试等待时长，0 代表没有建议。
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("通道上线失败 %d: %s", e.Code, e.Message)
+}
+
+// Fatal 是否是重试也无法解决的错误，例如：密钥错误、broker 已被删除，遇到这类错误应当停止重连。
+//
+// 中心端给出了重试建议的错误均可以重试。
+func (e *AuthError) Fatal() bool {
+	if e.RetryAfter > 0 {
+		return false
+	}
+
+	switch e.Code {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	default:
+		return false
+	}
 }
 
 type muxInstance struct {
-	ptr atomic.Pointer[muxconn.Muxer]
+	ptr   atomic.Pointer[muxconn.Muxer]
+	limit atomic.Pointer[rate.Limit] // 设置过的限速，断线重连后对新通道继续生效。
 }
 
 func (m *muxInstance) Accept() (net.Conn, error)                  { return m.load().Accept() }
@@ -55,7 +89,12 @@ func (m *muxInstance) RemoteAddr() net.Addr                       { return m.loa
 func (m *muxInstance) Library() (string, string)                  { return m.load().Library() }
 func (m *muxInstance) Traffic() (uint64, uint64)                  { return m.load().Traffic() }
 func (m *muxInstance) Limit() rate.Limit                          { return m.load().Limit() }
-func (m *muxInstance) SetLimit(bps rate.Limit)                    { m.load().SetLimit(bps) }
+func (m *muxInstance) SetLimit(bps rate.Limit)                    { m.limit.Store(&bps); m.load().SetLimit(bps) }
 func (m *muxInstance) NumStreams() (int64, int64)                 { return m.load().NumStreams() }
 func (m *muxInstance) load() muxconn.Muxer                        { return *m.ptr.Load() }
-func (m *muxInstance) store(mux muxconn.Muxer)                    { m.ptr.Store(&mux) }
+func (m *muxInstance) store(mux muxconn.Muxer) {
+	if bps := m.limit.Load(); bps != nil {
+		mux.SetLimit(*bps)
+	}
+	m.ptr.Store(&mux)
+}
@@ -0,0 +1,236 @@
+package clientd
+
+import (
+	"cmp"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EndpointStat 中心端接入点（地址 + 协议）的连接统计。
+type EndpointStat struct {
+	Address       string    `json:"address"`                  // 地址
+	Protocol      string    `json:"protocol"`                 // 协议
+	Successes     int       `json:"successes"`                // 累计连接成功次数
+	Failures      int       `json:"failures"`                 // 累计连接失败次数
+	Consecutive   int       `json:"consecutive"`              // 连续失败次数
+	Latency       int64     `json:"latency"`                  // 建立通道并完成认证的平均耗时（毫秒），没有成功过为 0
+	Score         float64   `json:"score"`                    // 健康评分，越高越优先
+	Active        bool      `json:"active"`                   // 是否是当前正在使用的接入点
+	LastError     string    `json:"last_error,omitzero"`      // 最近一次失败的原因
+	LastSuccessAt time.Time `json:"last_success_at,omitzero"` // 最近一次连接成功的时间
+	LastFailureAt time.Time `json:"last_failure_at,omitzero"` // 最近一次连接失败的时间
+}
+
+// endpoint 一个接入点。
+type endpoint struct {
+	index       int // 在配置中的顺序，评分相同时按配置的顺序
+	address     string
+	protocol    string
+	successes   int
+	failures    int
+	consecutive int
+	latency     time.Duration // 耗时的指数移动平均
+	lastError   string
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+// endpoints 根据历史连接的成功率与耗时为接入点评分，优先连接最健康的接入点。
+//
+// 同一个协议在所有地址上都失败（例如：网络封禁了 UDP 导致 quic 不通）时，
+// 该协议整体降权，自动回退到 websocket 上的 smux yamux。
+type endpoints struct {
+	mutex  sync.Mutex
+	items  []*endpoint
+	active *endpoint
+}
+
+// newEndpoints 地址与协议的规范化规则与 muxconn.Open 保持一致。
+func newEndpoints(addresses, protocols []string) *endpoints {
+	addrs := make([]string, 0, len(addresses))
+	for _, addr := range addresses {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "443")
+		}
+		if !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, "localhost:443")
+	}
+
+	protos := make([]string, 0, 4)
+	for _, proto := range protocols {
+		proto = strings.ToLower(proto)
+		switch proto {
+		case "quic", "quic-go", "smux", "yamux":
+		default:
+			continue
+		}
+		if !slices.Contains(protos, proto) {
+			protos = append(protos, proto)
+		}
+	}
+	if len(protos) == 0 {
+		protos = append(protos, "quic", "quic-go", "smux", "yamux")
+	}
+
+	items := make([]*endpoint, 0, len(addrs)*len(protos))
+	for _, addr := range addrs {
+		for _, proto := range protos {
+			items = append(items, &endpoint{index: len(items), address: addr, protocol: proto})
+		}
+	}
+
+	return &endpoints{items: items}
+}
+
+// candidates 按照评分从高到低排列的接入点，处于冷却期（连续失败）的接入点排在最后。
+func (eps *endpoints) candidates() []*endpoint {
+	eps.mutex.Lock()
+	defer eps.mutex.Unlock()
+
+	now := time.Now()
+	protos := eps.protocolRates()
+	type scored struct {
+		ep      *endpoint
+		score   float64
+		cooling bool
+	}
+	scores := make([]scored, 0, len(eps.items))
+	for _, ep := range eps.items {
+		scores = append(scores, scored{
+			ep:      ep,
+			score:   ep.score(protos[ep.protocol]),
+			cooling: ep.cooling(now),
+		})
+	}
+	slices.SortStableFunc(scores, func(a, b scored) int {
+		if a.cooling != b.cooling {
+			if a.cooling {
+				return 1
+			}
+			return -1
+		}
+		if c := cmp.Compare(b.score, a.score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ep.index, b.ep.index)
+	})
+
+	rets := make([]*endpoint, 0, len(scores))
+	for _, sc := range scores {
+		rets = append(rets, sc.ep)
+	}
+
+	return rets
+}
+
+func (eps *endpoints) succeeded(ep *endpoint, latency time.Duration) {
+	eps.mutex.Lock()
+	defer eps.mutex.Unlock()
+
+	ep.successes++
+	ep.consecutive = 0
+	ep.lastSuccess = time.Now()
+	if ep.latency == 0 {
+		ep.latency = latency
+	} else {
+		ep.latency = (ep.latency*7 + latency) / 8
+	}
+	eps.active = ep
+}
+
+func (eps *endpoints) failed(ep *endpoint, err error) {
+	eps.mutex.Lock()
+	defer eps.mutex.Unlock()
+
+	ep.failures++
+	ep.consecutive++
+	ep.lastFailure = time.Now()
+	ep.lastError = err.Error()
+}
+
+// disconnected 正在使用的接入点断开了。
+func (eps *endpoints) disconnected() {
+	eps.mutex.Lock()
+	defer eps.mutex.Unlock()
+
+	eps.active = nil
+}
+
+func (eps *endpoints) stats() []EndpointStat {
+	eps.mutex.Lock()
+	defer eps.mutex.Unlock()
+
+	protos := eps.protocolRates()
+	rets := make([]EndpointStat, 0, len(eps.items))
+	for _, ep := range eps.items {
+		rets = append(rets, EndpointStat{
+			Address:       ep.address,
+			Protocol:      ep.protocol,
+			Successes:     ep.successes,
+			Failures:      ep.failures,
+			Consecutive:   ep.consecutive,
+			Latency:       ep.latency.Milliseconds(),
+			Score:         ep.score(protos[ep.protocol]),
+			Active:        ep == eps.active,
+			LastError:     ep.lastError,
+			LastSuccessAt: ep.lastSuccess,
+			LastFailureAt: ep.lastFailure,
+		})
+	}
+
+	return rets
+}
+
+// protocolRates 每个协议在所有地址上的成功率，调用方需要持有锁。
+func (eps *endpoints) protocolRates() map[string]float64 {
+	succ := make(map[string]int, 4)
+	fail := make(map[string]int, 4)
+	for _, ep := range eps.items {
+		succ[ep.protocol] += ep.successes
+		fail[ep.protocol] += ep.failures
+	}
+
+	rets := make(map[string]float64, len(succ))
+	for proto, s := range succ {
+		rets[proto] = successRate(s, fail[proto])
+	}
+
+	return rets
+}
+
+// score 健康评分：接入点成功率 × 协议成功率 × 耗时系数。
+func (ep *endpoint) score(protoRate float64) float64 {
+	rate := successRate(ep.successes, ep.failures)
+	latency := ep.latency
+	if latency <= 0 {
+		latency = time.Second // 没有连接成功过的接入点按照 1s 估算，避免排在已知可用的接入点之前。
+	}
+	factor := 1 / (1 + float64(latency)/float64(500*time.Millisecond))
+
+	return rate * protoRate * factor
+}
+
+// cooling 连续失败后进入冷却期，冷却时长随连续失败次数指数增长，最长 5 分钟。
+func (ep *endpoint) cooling(now time.Time) bool {
+	if ep.consecutive == 0 {
+		return false
+	}
+	du := 5 * time.Minute
+	if ep.consecutive < 6 {
+		du = min(du, 5*time.Second<<ep.consecutive)
+	}
+
+	return now.Sub(ep.lastFailure) < du
+}
+
+// successRate 拉普拉斯平滑后的成功率，没有连接过的接入点为 0.5。
+func successRate(successes, failures int) float64 {
+	return float64(successes+1) / float64(successes+failures+2)
+}
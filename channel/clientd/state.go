@@ -0,0 +1,124 @@
+package clientd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/xmx/metrics"
+)
+
+// 中心端通道的连接状态。
+const (
+	LinkConnected    = "connected"    // 已连接
+	LinkReconnecting = "reconnecting" // 断线重连中
+	LinkClosed       = "closed"       // 已关闭，不再重连
+)
+
+// LinkState 中心端通道的连接状态。
+//
+// 断线重连期间 broker 仍然正常接入和服务节点，只是发往中心端的请求会失败，
+// 需要上报中心端的数据应当暂存起来，等重连成功后再上报。
+type LinkState struct {
+	Status         string    `json:"status"`                   // 连接状态
+	Address        string    `json:"address,omitzero"`         // 当前（或最近一次）使用的接入点地址
+	Protocol       string    `json:"protocol,omitzero"`        // 当前（或最近一次）使用的接入点协议
+	Attempts       int       `json:"attempts"`                 // 本轮重连已经尝试的次数
+	Reconnects     int       `json:"reconnects"`               // 累计重连成功的次数
+	LastError      string    `json:"last_error,omitzero"`      // 最近一次断线或者重连失败的原因
+	ConnectedAt    time.Time `json:"connected_at,omitzero"`    // 最近一次连接成功的时间
+	DisconnectedAt time.Time `json:"disconnected_at,omitzero"` // 最近一次断线的时间
+}
+
+// Connected 是否已连接。
+func (ls LinkState) Connected() bool {
+	return ls.Status == LinkConnected
+}
+
+type linkState struct {
+	mutex    sync.Mutex
+	state    LinkState
+	watchers []func(LinkState)
+}
+
+func newLinkState() *linkState {
+	ls := &linkState{state: LinkState{Status: LinkReconnecting}}
+	metrics.GetOrCreateGauge("aegis_broker_upstream_connected", func() float64 {
+		if ls.load().Connected() {
+			return 1
+		}
+		return 0
+	})
+	metrics.GetOrCreateGauge("aegis_broker_upstream_reconnect_attempts", func() float64 {
+		return float64(ls.load().Attempts)
+	})
+	metrics.GetOrCreateGauge("aegis_broker_upstream_reconnects", func() float64 {
+		return float64(ls.load().Reconnects)
+	})
+
+	return ls
+}
+
+func (ls *linkState) load() LinkState {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	return ls.state
+}
+
+func (ls *linkState) watch(fn func(LinkState)) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	ls.watchers = append(ls.watchers, fn)
+}
+
+// update 修改连接状态，状态（Status）变化时通知回调。
+func (ls *linkState) update(fn func(*LinkState)) {
+	ls.mutex.Lock()
+	old := ls.state.Status
+	fn(&ls.state)
+	cur := ls.state
+	watchers := ls.watchers
+	ls.mutex.Unlock()
+
+	if old == cur.Status {
+		return
+	}
+	for _, w := range watchers {
+		w(cur)
+	}
+}
+
+func (ls *linkState) failed(err error) {
+	ls.update(func(s *LinkState) {
+		s.Attempts++
+		s.LastError = err.Error()
+	})
+}
+
+func (ls *linkState) connected() {
+	ls.update(func(s *LinkState) {
+		if !s.ConnectedAt.IsZero() {
+			s.Reconnects++
+		}
+		s.Status = LinkConnected
+		s.Attempts = 0
+		s.ConnectedAt = time.Now()
+	})
+}
+
+func (ls *linkState) disconnected(err error) {
+	ls.update(func(s *LinkState) {
+		s.Status = LinkReconnecting
+		s.DisconnectedAt = time.Now()
+		if err != nil {
+			s.LastError = err.Error()
+		}
+	})
+}
+
+func (ls *linkState) closed() {
+	ls.update(func(s *LinkState) {
+		s.Status = LinkClosed
+	})
+}
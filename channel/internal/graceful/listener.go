@@ -0,0 +1,35 @@
+// Package graceful 通道优雅关闭的辅助工具。
+package graceful
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// NewListener 将通道包装为 listener，关闭时不关闭底层的通道，只是不再接受新的子流。
+//
+// http.Server.Shutdown 会先关闭 listener 再等待请求完成，如果直接把通道作为 listener，
+// 关闭通道会中断所有正在处理的子流。
+func NewListener(lis net.Listener) net.Listener {
+	return &listener{Listener: lis}
+}
+
+type listener struct {
+	net.Listener
+	closed atomic.Bool
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil && l.closed.Load() {
+		_ = conn.Close()
+		return nil, net.ErrClosed
+	}
+
+	return conn, err
+}
+
+func (l *listener) Close() error {
+	l.closed.Store(true)
+	return nil
+}
@@ -12,7 +12,12 @@ type Client struct {
 	base muxtool.Client
 }
 
+// NewClient 创建 RPC 客户端，base 的 Transport 会被包装为 NewTraceTransport。
 func NewClient(base muxtool.Client) Client {
+	if cli := base.HTTPClient(); cli != nil {
+		cli.Transport = NewTraceTransport(cli.Transport)
+	}
+
 	return Client{
 		base: base,
 	}
@@ -28,3 +33,21 @@ func (c Client) Ping(ctx context.Context) error {
 
 	return c.base.JSON(ctx, http.MethodGet, strURL, nil)
 }
+
+// Migrate 通知节点断开当前 broker 并连接到其它的接入点。
+func (c Client) Migrate(ctx context.Context, agentID string, addresses []string) error {
+	reqURL := muxproto.ToAgentURL(agentID, "/api/system/migrate")
+	strURL := reqURL.String()
+	body := map[string]any{"addresses": addresses}
+
+	return c.base.SendJSON(ctx, http.MethodPost, strURL, body, nil)
+}
+
+// TunnelEvents 批量上报节点通道的上下线事件。
+func (c Client) TunnelEvents(ctx context.Context, events any) error {
+	reqURL := muxproto.ToServerURL("/api/broker/tunnel/events")
+	strURL := reqURL.String()
+	body := map[string]any{"events": events}
+
+	return c.base.SendJSON(ctx, http.MethodPost, strURL, body, nil)
+}
@@ -0,0 +1,63 @@
+package rpclient
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewTraceTransport 为经过 broker 转发的请求创建 client span，
+// 并将 trace 上下文注入到请求头中，使得 server -> broker -> agent 在同一条链路上。
+func NewTraceTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if _, ok := next.(*traceTransport); ok {
+		return next
+	}
+
+	return &traceTransport{
+		next:   next,
+		tracer: otel.Tracer("aegis-broker-rpclient"),
+	}
+}
+
+type traceTransport struct {
+	next   http.RoundTripper
+	tracer trace.Tracer
+}
+
+func (tt *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	spanName := req.Method + " " + req.URL.Path
+	ctx, span := tt.tracer.Start(req.Context(), spanName, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("http.method", req.Method),
+		attribute.String("http.host", req.URL.Host),
+		attribute.String("http.path", req.URL.Path),
+	)
+
+	// RoundTripper 不应修改原始请求，所以要克隆一份再注入。
+	newReq := req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(newReq.Header))
+
+	res, err := tt.next.RoundTrip(newReq)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	code := res.StatusCode
+	span.SetAttributes(attribute.Int("http.status_code", code))
+	if code >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(code))
+	}
+
+	return res, nil
+}
@@ -0,0 +1,240 @@
+package serverd
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/xmx/aegis-common/muxlink/muxconn"
+	"github.com/xmx/aegis-control/datalayer/repository"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Authenticator 节点认证器。
+//
+// 节点上线时，在读取并校验认证报文之后、写入数据库之前调用。
+// 凭据不匹配时返回 ErrUnauthorized（或包装了它的错误），节点会收到 401 响应并断开连接；
+// 其它错误（如：查询数据库出错）视为暂时不可用，节点会收到 503 响应，稍后重试。
+type Authenticator interface {
+	// Authenticate 认证节点，认证通过后返回认证结果，该结果会保存在节点数据中。
+	Authenticate(ctx context.Context, sub *AuthSubject) (*AuthResult, error)
+}
+
+// AuthenticatorFunc 函数形式的 Authenticator。
+type AuthenticatorFunc func(ctx context.Context, sub *AuthSubject) (*AuthResult, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, sub *AuthSubject) (*AuthResult, error) {
+	return f(ctx, sub)
+}
+
+// AuthSubject 待认证的节点。
+type AuthSubject struct {
+	// Request 节点发来的认证报文。
+	Request *AuthRequest
+
+	// Registered 节点是否已经注册过（数据库中已存在）。
+	Registered bool
+
+	// Certificates 节点出示的客户端证书，第一个为叶子证书。
+	// 只有在 mTLS 模式下才会有值。
+	Certificates []*x509.Certificate
+}
+
+// AuthResult 认证结果，保存在节点数据的 authentication 字段。
+type AuthResult struct {
+	Method          string    `json:"method"            bson:"method"`             // 认证方式
+	Subject         string    `json:"subject,omitzero"  bson:"subject,omitempty"`  // 认证主体，如：令牌名、证书指纹
+	AuthenticatedAt time.Time `json:"authenticated_at"  bson:"authenticated_at"`   // 认证时间
+	Enrolled        bool      `json:"enrolled,omitzero" bson:"enrolled,omitempty"` // 是否在本次认证时注册
+}
+
+// ErrUnauthorized 认证失败，凭据不匹配。
+var ErrUnauthorized = errors.New("节点认证失败")
+
+const (
+	AuthMethodToken       = "token"
+	AuthMethodSecret      = "secret"
+	AuthMethodCertificate = "certificate"
+)
+
+// NewTokenAuthenticator 注册令牌认证，持有任意一个有效令牌的节点均可注册上线。
+// tokens 为令牌名与令牌值的映射，令牌名会作为认证主体记录下来。
+func NewTokenAuthenticator(tokens map[string]string) Authenticator {
+	return &tokenAuthenticator{tokens: tokens}
+}
+
+type tokenAuthenticator struct {
+	tokens map[string]string
+}
+
+func (ta *tokenAuthenticator) Authenticate(_ context.Context, sub *AuthSubject) (*AuthResult, error) {
+	secret := sub.Request.Secret
+	if secret == "" {
+		return nil, ErrUnauthorized
+	}
+
+	for name, token := range ta.tokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1 {
+			return &AuthResult{Method: AuthMethodToken, Subject: name, AuthenticatedAt: time.Now()}, nil
+		}
+	}
+
+	return nil, ErrUnauthorized
+}
+
+// NewSecretAuthenticator 预共享密钥认证，每个节点一个密钥。
+//
+// 节点需要预先在数据库中登记，并在 credential.secret 中保存密钥的 SHA-256 摘要（十六进制）。
+// 未登记的节点一律拒绝。
+func NewSecretAuthenticator(repo repository.All) Authenticator {
+	return &secretAuthenticator{repo: repo}
+}
+
+type secretAuthenticator struct {
+	repo repository.All
+}
+
+func (sa *secretAuthenticator) Authenticate(ctx context.Context, sub *AuthSubject) (*AuthResult, error) {
+	secret := sub.Request.Secret
+	if !sub.Registered || secret == "" {
+		return nil, ErrUnauthorized
+	}
+
+	cred, err := findCredential(ctx, sa.repo, sub.Request.MachineID)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Secret == "" {
+		return nil, ErrUnauthorized
+	}
+
+	sum := sha256.Sum256([]byte(secret))
+	digest := hex.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(digest), []byte(strings.ToLower(cred.Secret))) != 1 {
+		return nil, ErrUnauthorized
+	}
+
+	return &AuthResult{Method: AuthMethodSecret, AuthenticatedAt: time.Now()}, nil
+}
+
+// NewCertificateAuthenticator 客户端证书指纹认证。
+//
+// 节点需要预先在数据库中登记，并在 credential.fingerprint 中保存客户端证书的
+// SHA-256 指纹（十六进制）。
+func NewCertificateAuthenticator(repo repository.All) Authenticator {
+	return &certificateAuthenticator{repo: repo}
+}
+
+type certificateAuthenticator struct {
+	repo repository.All
+}
+
+func (ca *certificateAuthenticator) Authenticate(ctx context.Context, sub *AuthSubject) (*AuthResult, error) {
+	if !sub.Registered || len(sub.Certificates) == 0 {
+		return nil, ErrUnauthorized
+	}
+
+	cred, err := findCredential(ctx, ca.repo, sub.Request.MachineID)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Fingerprint == "" {
+		return nil, ErrUnauthorized
+	}
+
+	fingerprint := Fingerprint(sub.Certificates[0])
+	if subtle.ConstantTimeCompare([]byte(fingerprint), []byte(strings.ToLower(cred.Fingerprint))) != 1 {
+		return nil, ErrUnauthorized
+	}
+
+	return &AuthResult{Method: AuthMethodCertificate, Subject: fingerprint, AuthenticatedAt: time.Now()}, nil
+}
+
+// NewChainAuthenticator 依次尝试多个认证器，任意一个认证通过即可。
+//
+// 所有认证器都认证失败时，只要有一个认证器是因为凭据不匹配以外的原因（如：数据库出错）失败的，
+// 就返回这些错误，而不是 ErrUnauthorized，避免暂时性的故障被当作凭据错误。
+func NewChainAuthenticator(auths ...Authenticator) Authenticator {
+	return &chainAuthenticator{auths: auths}
+}
+
+type chainAuthenticator struct {
+	auths []Authenticator
+}
+
+func (ca *chainAuthenticator) Authenticate(ctx context.Context, sub *AuthSubject) (*AuthResult, error) {
+	var errs []error
+	for _, a := range ca.auths {
+		ret, err := a.Authenticate(ctx, sub)
+		if err == nil {
+			return ret, nil
+		}
+		if !errors.Is(err, ErrUnauthorized) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return nil, ErrUnauthorized
+}
+
+// Fingerprint 计算证书的 SHA-256 指纹。
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// WithCertificates 将客户端证书附加到 Muxer 上，供 Authenticator 认证使用。
+func WithCertificates(mux muxconn.Muxer, certs []*x509.Certificate) muxconn.Muxer {
+	if len(certs) == 0 {
+		return mux
+	}
+
+	return &certMuxer{Muxer: mux, certs: certs}
+}
+
+type certMuxer struct {
+	muxconn.Muxer
+	certs []*x509.Certificate
+}
+
+func (cm *certMuxer) PeerCertificates() []*x509.Certificate { return cm.certs }
+
+func peerCertificates(mux muxconn.Muxer) []*x509.Certificate {
+	if pc, ok := mux.(interface{ PeerCertificates() []*x509.Certificate }); ok {
+		return pc.PeerCertificates()
+	}
+
+	return nil
+}
+
+// agentCredential 节点预登记的认证凭据，保存在节点数据的 credential 字段。
+type agentCredential struct {
+	Secret      string `bson:"secret,omitempty"`      // 预共享密钥的 SHA-256 摘要
+	Fingerprint string `bson:"fingerprint,omitempty"` // 客户端证书 SHA-256 指纹
+}
+
+func findCredential(ctx context.Context, repo repository.All, machineID string) (*agentCredential, error) {
+	var doc struct {
+		Credential agentCredential `bson:"credential"`
+	}
+
+	coll := repo.Agent().Collection()
+	filter := bson.M{"machine_id": machineID}
+	if err := coll.FindOne(ctx, filter).Decode(&doc); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrUnauthorized
+		}
+		return nil, err
+	}
+
+	return &doc.Credential, nil
+}
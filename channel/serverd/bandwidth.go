@@ -0,0 +1,23 @@
+package serverd
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"golang.org/x/time/rate"
+)
+
+// Bandwidther 节点通道带宽策略。
+//
+// 节点认证通过、加入连接池之后调用，用于设置该节点通道的限速。
+type Bandwidther interface {
+	// Bandwidth 查询节点通道的带宽上限（字节/秒），rate.Inf 代表不限制。
+	Bandwidth(ctx context.Context, agentID bson.ObjectID) (rate.Limit, error)
+}
+
+// BandwidtherFunc 函数形式的 Bandwidther。
+type BandwidtherFunc func(ctx context.Context, agentID bson.ObjectID) (rate.Limit, error)
+
+func (f BandwidtherFunc) Bandwidth(ctx context.Context, agentID bson.ObjectID) (rate.Limit, error) {
+	return f(ctx, agentID)
+}
@@ -1,7 +1,10 @@
 package serverd
 
+import "github.com/xmx/aegis-control/datalayer/model"
+
 type AuthRequest struct {
 	MachineID  string   `json:"machine_id"          validate:"required,gte=10,lte=100"`
+	Secret     string   `json:"secret,omitzero"     validate:"lte=1000"` // 注册令牌或预共享密钥
 	Semver     string   `json:"semver"              validate:"required,semver"`
 	Inet       string   `json:"inet"                validate:"required,ip"`
 	Goos       string   `json:"goos"                validate:"required,oneof=darwin dragonfly illumos ios js wasip1 linux android solaris freebsd nacl netbsd openbsd plan9 windows aix"`
@@ -14,6 +17,14 @@ type AuthRequest struct {
 }
 
 type authResponse struct {
-	Code    int    `json:"code"`
-	Message string `json:"message,omitzero"`
+	Code       int    `json:"code"`
+	Message    string `json:"message,omitzero"`
+	RetryAfter int    `json:"retry_after,omitzero"` // 建议节点多少秒后再重试，限流时才会有值。
+}
+
+// connectHistory 连接历史记录，在公共模型的基础上扩展了下线原因。
+type connectHistory struct {
+	model.AgentConnectHistory `bson:",inline"`
+
+	Reason DisconnectReason `json:"reason" bson:"reason"` // 下线原因
 }
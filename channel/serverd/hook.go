@@ -0,0 +1,41 @@
+package serverd
+
+import (
+	"time"
+
+	"github.com/xmx/aegis-control/linkhub"
+)
+
+// PeerHooker 可选的扩展接口，ServerHooker 实现了该接口时，节点上下线时调用 PeerHooker 的方法
+// 代替 ServerHooker 的方法。
+//
+// linkhub.Info 中没有节点 ID，也没有下线原因，上报上下线事件时需要这些信息。
+type PeerHooker interface {
+	OnPeerConnected(peer linkhub.Peer, connectAt time.Time)
+
+	OnPeerDisconnected(peer linkhub.Peer, connectAt, disconnectAt time.Time, reason DisconnectReason)
+}
+
+func (as *agentServer) onConnected(peer linkhub.Peer, connectAt time.Time) {
+	sh := as.opts.ServerHooker
+	if sh == nil {
+		return
+	}
+	if ph, ok := sh.(PeerHooker); ok {
+		ph.OnPeerConnected(peer, connectAt)
+	} else {
+		sh.OnConnected(peer.Info(), connectAt)
+	}
+}
+
+func (as *agentServer) onDisconnected(peer linkhub.Peer, connectAt, disconnectAt time.Time, reason DisconnectReason) {
+	sh := as.opts.ServerHooker
+	if sh == nil {
+		return
+	}
+	if ph, ok := sh.(PeerHooker); ok {
+		ph.OnPeerDisconnected(peer, connectAt, disconnectAt, reason)
+	} else {
+		sh.OnDisconnected(peer.Info(), connectAt, disconnectAt)
+	}
+}
@@ -0,0 +1,83 @@
+package serverd
+
+import (
+	"context"
+	"time"
+
+	"github.com/xmx/aegis-common/muxlink/muxproto"
+	"github.com/xmx/aegis-control/linkhub"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Server 节点通道服务端，除了处理节点连接，还可以查询当前在线节点的连接会话。
+type Server interface {
+	muxproto.MUXAccepter
+
+	// Sessions 当前 broker 上所有在线节点的连接会话。
+	Sessions() []SessionStat
+
+	// Session 查询节点的连接会话，节点不在线时返回 false。
+	Session(agentID bson.ObjectID) (SessionStat, bool)
+
+	// Keepalive 记录节点的心跳时间。
+	Keepalive(agentID bson.ObjectID, at time.Time)
+
+	// Kick 强制节点下线，ban 大于 0 时在该时长内禁止节点再次上线（对所有 broker 生效），返回节点是否在线。
+	Kick(agentID bson.ObjectID, reason string, ban time.Duration) (bool, error)
+
+	// Disconnect 由 broker 主动断开节点通道，category 为下线原因分类（Reason* 常量），返回节点是否在线。
+	Disconnect(agentID bson.ObjectID, category, message string) bool
+
+	// Unban 解除节点的上线封禁。
+	Unban(agentID bson.ObjectID) error
+
+	// SetDraining 设置排空模式，排空模式下拒绝新节点上线，已在线的节点不受影响。
+	SetDraining(draining bool)
+
+	// Draining 是否处于排空模式。
+	Draining() bool
+
+	// Shutdown 优雅关闭所有节点通道，ctx 用于限制等待请求完成的时长。
+	Shutdown(ctx context.Context) error
+}
+
+// SessionStat 节点连接会话的状态。
+type SessionStat struct {
+	ID          bson.ObjectID // 会话 ID
+	Peer        linkhub.Peer  // 节点
+	ConnectAt   time.Time     // 上线时间
+	KeepaliveAt time.Time     // 最近一次心跳时间，没有心跳时为上线时间。
+	RTT         time.Duration // 最近一次主动探测的 RTT，没有探测过为 0。
+}
+
+func (as *agentServer) Sessions() []SessionStat {
+	sessions := as.sessions.all()
+	ret := make([]SessionStat, 0, len(sessions))
+	for _, s := range sessions {
+		ret = append(ret, s.stat())
+	}
+
+	return ret
+}
+
+func (as *agentServer) Session(agentID bson.ObjectID) (SessionStat, bool) {
+	if s := as.sessions.get(agentID); s != nil {
+		return s.stat(), true
+	}
+
+	return SessionStat{}, false
+}
+
+func (as *agentServer) Keepalive(agentID bson.ObjectID, at time.Time) {
+	if s := as.sessions.get(agentID); s != nil {
+		s.keepalive.Store(at.UnixNano())
+	}
+}
+
+func (as *agentServer) SetDraining(draining bool) {
+	as.draining.Store(draining)
+}
+
+func (as *agentServer) Draining() bool {
+	return as.draining.Load()
+}
@@ -0,0 +1,83 @@
+package serverd
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Kick 强制节点下线，断开其通道并执行正常的下线处理（修改在线状态、写入连接历史记录）。
+//
+// ban 大于 0 时，节点在该时长内无法再次上线。封禁保存在节点数据的 ban 字段，
+// 对所有 broker 都生效，broker 重启后依然有效，节点不在线时仍然会生效。
+// 返回节点是否在线，在线时会等待下线处理完毕。
+func (as *agentServer) Kick(agentID bson.ObjectID, reason string, ban time.Duration) (bool, error) {
+	if ban > 0 {
+		dat := &agentBan{Reason: reason, ExpiresAt: time.Now().Add(ban)}
+		if err := as.updateBan(agentID, bson.M{"$set": bson.M{"ban": dat}}); err != nil {
+			return false, err
+		}
+	}
+
+	return as.Disconnect(agentID, ReasonAdminKick, reason), nil
+}
+
+// Disconnect 由 broker 主动断开节点通道，category 为下线原因分类，message 为原因描述。
+// 返回节点是否在线，在线时会等待下线处理完毕。
+func (as *agentServer) Disconnect(agentID bson.ObjectID, category, message string) bool {
+	sess := as.sessions.get(agentID)
+	if sess == nil {
+		return false
+	}
+	attrs := []any{"info", sess.peer.Info(), "category", category, "message", message}
+	as.log().Warn("断开节点通道", attrs...)
+	sess.close(category, message)
+	if !sess.wait(2 * as.timeout()) {
+		as.log().Warn("等待节点下线处理超时", attrs...)
+	}
+
+	return true
+}
+
+// Unban 解除节点的上线封禁。
+func (as *agentServer) Unban(agentID bson.ObjectID) error {
+	return as.updateBan(agentID, bson.M{"$unset": bson.M{"ban": ""}})
+}
+
+func (as *agentServer) updateBan(agentID bson.ObjectID, update bson.M) error {
+	ctx, cancel := as.perContext()
+	defer cancel()
+
+	ret, err := as.repo.Agent().UpdateByID(ctx, agentID, update)
+	if err != nil {
+		return err
+	} else if ret.MatchedCount == 0 {
+		return errors.New("节点不存在")
+	}
+
+	return nil
+}
+
+// agentBan 节点上线封禁，保存在节点数据的 ban 字段。
+type agentBan struct {
+	Reason    string    `bson:"reason,omitempty"` // 封禁原因
+	ExpiresAt time.Time `bson:"expires_at"`       // 封禁截止时间
+}
+
+// checkBanned 检查节点是否被封禁，封禁时响应 403 并告知剩余的封禁时长。
+func checkBanned(ban *agentBan) (*authResponse, bool) {
+	if ban == nil || !time.Now().Before(ban.ExpiresAt) {
+		return nil, false
+	}
+
+	msg := "节点已被禁止上线"
+	if ban.Reason != "" {
+		msg += "：" + ban.Reason
+	}
+	seconds := int(time.Until(ban.ExpiresAt).Seconds()) + 1
+	dat := &authResponse{Code: http.StatusForbidden, Message: msg, RetryAfter: seconds}
+
+	return dat, true
+}
@@ -0,0 +1,36 @@
+package serverd
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Leaser broker 租约。
+//
+// 每个 broker 定期续约，节点的在线状态只有在其所属 broker 的租约有效时才可信。
+// broker 异常退出时来不及修正节点的在线状态，节点重连到其它 broker 时，
+// 如果原 broker 的租约已经过期，则直接接管该节点。
+type Leaser interface {
+	// Alive 判断 broker 的租约是否有效。
+	Alive(ctx context.Context, brokerID bson.ObjectID) (bool, error)
+}
+
+// leaseAlive 判断 broker 的租约是否有效，未配置租约或查询出错时视为有效。
+func (as *agentServer) leaseAlive(brokerID bson.ObjectID) bool {
+	l := as.opts.Leaser
+	if l == nil {
+		return true
+	}
+
+	ctx, cancel := as.perContext()
+	defer cancel()
+
+	alive, err := l.Alive(ctx, brokerID)
+	if err != nil {
+		as.log().Warn("查询 broker 租约出错", "broker_id", brokerID, "error", err)
+		return true
+	}
+
+	return alive
+}
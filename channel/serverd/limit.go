@@ -0,0 +1,177 @@
+package serverd
+
+import (
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xmx/aegis-common/muxlink/muxconn"
+	"golang.org/x/time/rate"
+)
+
+// Limiter 节点上线准入控制器。
+type Limiter interface {
+	// Admit 判断是否允许该连接进行认证握手。
+	//
+	// 允许时返回的 release 不为 nil，握手结束（无论成功与否）后必须调用。
+	// 拒绝时返回建议节点等待多久之后再重试。
+	Admit(mux muxconn.Muxer) (release func(), retryAfter time.Duration, allowed bool)
+}
+
+// AdmissionConfig 内置准入控制器的配置。
+type AdmissionConfig struct {
+	// Rate 每个网段每秒允许的握手次数，小于等于 0 代表不限制。
+	Rate float64
+
+	// Burst 每个网段的令牌桶容量，小于等于 0 时取 Rate 向上取整。
+	Burst int
+
+	// IPv4Prefix IPv4 网段掩码长度，默认 32 即按单个 IP 限制。
+	IPv4Prefix int
+
+	// IPv6Prefix IPv6 网段掩码长度，默认 64。
+	IPv6Prefix int
+
+	// MaxHandshakes 全局最大并发握手数，小于等于 0 代表不限制。
+	MaxHandshakes int
+
+	// RetryAfter 超出并发握手数时建议节点等待的时长，默认 10s。
+	RetryAfter time.Duration
+}
+
+// NewAdmission 内置的准入控制器：按来源网段的令牌桶限速 + 全局最大并发握手数。
+//
+// broker 重启后所有节点会几乎同时重连，如果不加以控制，大量的握手请求会直接打到数据库上。
+func NewAdmission(cfg AdmissionConfig) Limiter {
+	if cfg.IPv4Prefix <= 0 || cfg.IPv4Prefix > 32 {
+		cfg.IPv4Prefix = 32
+	}
+	if cfg.IPv6Prefix <= 0 || cfg.IPv6Prefix > 128 {
+		cfg.IPv6Prefix = 64
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(math.Ceil(cfg.Rate))
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = 10 * time.Second
+	}
+
+	return &admission{
+		cfg:     cfg,
+		buckets: make(map[netip.Prefix]*bucket, 64),
+	}
+}
+
+type admission struct {
+	cfg        AdmissionConfig
+	handshakes atomic.Int64
+	mutex      sync.Mutex
+	buckets    map[netip.Prefix]*bucket
+	cleanAt    time.Time
+}
+
+type bucket struct {
+	limit  *rate.Limiter
+	seenAt time.Time
+}
+
+func (a *admission) Admit(mux muxconn.Muxer) (func(), time.Duration, bool) {
+	if wait := a.reserve(mux.RemoteAddr()); wait > 0 {
+		return nil, wait, false
+	}
+
+	maximum := int64(a.cfg.MaxHandshakes)
+	if maximum <= 0 {
+		return func() {}, 0, true
+	}
+	if n := a.handshakes.Add(1); n > maximum {
+		a.handshakes.Add(-1)
+		return nil, a.cfg.RetryAfter, false
+	}
+
+	var once sync.Once
+	release := func() { once.Do(func() { a.handshakes.Add(-1) }) }
+
+	return release, 0, true
+}
+
+// reserve 从来源网段的令牌桶中取一个令牌，返回需要等待的时长，0 代表放行。
+func (a *admission) reserve(addr net.Addr) time.Duration {
+	if a.cfg.Rate <= 0 {
+		return 0
+	}
+	prefix, ok := a.prefix(addr)
+	if !ok {
+		return 0
+	}
+
+	now := time.Now()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.cleanup(now)
+	bkt := a.buckets[prefix]
+	if bkt == nil {
+		bkt = &bucket{limit: rate.NewLimiter(rate.Limit(a.cfg.Rate), a.cfg.Burst)}
+		a.buckets[prefix] = bkt
+	}
+	bkt.seenAt = now
+
+	rsv := bkt.limit.ReserveN(now, 1)
+	if !rsv.OK() {
+		return a.cfg.RetryAfter
+	}
+	if wait := rsv.DelayFrom(now); wait > 0 {
+		rsv.CancelAt(now) // 拒绝就不占用令牌
+		return max(wait, time.Second)
+	}
+
+	return 0
+}
+
+// cleanup 清理长时间没有握手的网段，避免 map 无限增长。
+func (a *admission) cleanup(now time.Time) {
+	const idle = 10 * time.Minute
+	if now.Sub(a.cleanAt) < idle {
+		return
+	}
+	a.cleanAt = now
+
+	for k, bkt := range a.buckets {
+		if now.Sub(bkt.seenAt) > idle {
+			delete(a.buckets, k)
+		}
+	}
+}
+
+func (a *admission) prefix(addr net.Addr) (netip.Prefix, bool) {
+	if addr == nil {
+		return netip.Prefix{}, false
+	}
+
+	var ip netip.Addr
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		ip = v.AddrPort().Addr()
+	case *net.UDPAddr:
+		ip = v.AddrPort().Addr()
+	default:
+		ap, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		ip = ap.Addr()
+	}
+	ip = ip.Unmap()
+
+	bits := a.cfg.IPv6Prefix
+	if ip.Is4() {
+		bits = a.cfg.IPv4Prefix
+	}
+	prefix, err := ip.Prefix(bits)
+
+	return prefix, err == nil
+}
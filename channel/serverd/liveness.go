@@ -0,0 +1,55 @@
+package serverd
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// monitor 定期探测节点通道是否存活并记录 RTT，连续失败 ProbeFailures 次后断开通道。
+//
+// 不能完全依赖底层多路复用协议发现对端失联，部分协议（如 websocket 上的 smux yamux）
+// 在网络中断后要等 TCP 超时才能发现，期间节点无法重连到其它 broker。
+func (as *agentServer) monitor(sess *session) {
+	interval := as.opts.ProbeInterval
+	if interval <= 0 {
+		return
+	}
+	maxFailures := as.opts.ProbeFailures
+	if maxFailures <= 0 {
+		maxFailures = 3
+	}
+
+	// 随机延迟首次探测，避免 broker 重启后所有节点同时被探测。
+	jitter := rand.N(interval)
+	timer := time.NewTimer(interval + jitter)
+	defer timer.Stop()
+
+	var failures int
+	for {
+		select {
+		case <-sess.done:
+			return
+		case <-timer.C:
+		}
+
+		rtt, err := as.probe(sess.peer)
+		if err == nil {
+			failures = 0
+			sess.rtt.Store(int64(rtt))
+			timer.Reset(interval)
+			continue
+		}
+
+		failures++
+		attrs := []any{"info", sess.peer.Info(), "failures", failures, "error", err}
+		if failures < maxFailures {
+			as.log().Warn("节点通道探测失败", attrs...)
+			timer.Reset(interval)
+			continue
+		}
+
+		as.log().Warn("节点通道连续探测失败，断开连接", attrs...)
+		sess.close(ReasonKeepaliveTimeout, "keepalive timeout")
+		return
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/xmx/aegis-common/muxlink/muxconn"
+	"github.com/xmx/aegis-broker/outbox"
 	"github.com/xmx/aegis-control/linkhub"
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
@@ -17,9 +17,17 @@ type Options struct {
 	Handler       http.Handler
 	Huber         linkhub.Huber
 	Validator     func(any) error // 认证报文参数校验器
-	Limiter       func(muxconn.Muxer) bool
+	Authenticator Authenticator   // 节点认证器，为空时不认证，任意节点均可注册上线。
+	Limiter       Limiter         // 上线准入控制器，为空时不限制。
+	Bandwidth     Bandwidther     // 节点通道带宽策略，为空时不限速。
+	Leaser        Leaser          // broker 租约，为空时认为其它 broker 上的节点一直在线。
+	Outbox        outbox.Writer   // 节点下线状态与连接历史记录的写入器，为空时直接写入数据库。
 	Logger        *slog.Logger
 	Timeout       time.Duration
+	Takeover      bool          // 节点重复上线时，如果旧连接已经失联，则断开旧连接并接纳新连接。
+	ProbeTimeout  time.Duration // 探测节点通道是否存活的超时时间。
+	ProbeInterval time.Duration // 主动探测节点通道是否存活的间隔，0 代表不主动探测。
+	ProbeFailures int           // 连续探测失败多少次后断开节点通道，默认 3。
 	Context       context.Context
 }
 
@@ -0,0 +1,56 @@
+package serverd
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/xmx/aegis-control/linkhub"
+)
+
+// probe 探测节点通道是否存活。
+//
+// 打开一个子流并发送一个 HTTP 请求，只要收到任意 HTTP 响应（包括 404）即视为存活，
+// 仅仅打开子流是不够的，部分多路复用协议打开子流时并不会与对端交互。
+//
+//goland:noinspection GoUnhandledErrorResult
+func (as *agentServer) probe(peer linkhub.Peer) (time.Duration, error) {
+	timeout := as.probeTimeout()
+	ctx, cancel := context.WithTimeout(as.baseContext(), timeout)
+	defer cancel()
+
+	startAt := time.Now()
+	mux := peer.Muxer()
+	conn, err := mux.Open(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "http://"+peer.Host()+"/", nil)
+	if err != nil {
+		return 0, err
+	}
+	if err = req.Write(conn); err != nil {
+		return 0, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return 0, err
+	}
+	_ = res.Body.Close()
+
+	return time.Since(startAt), nil
+}
+
+func (as *agentServer) probeTimeout() time.Duration {
+	if du := as.opts.ProbeTimeout; du > 0 {
+		return du
+	}
+
+	return 5 * time.Second
+}
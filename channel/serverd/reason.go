@@ -0,0 +1,83 @@
+package serverd
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+	quicgo "github.com/quic-go/quic-go"
+	xquic "golang.org/x/net/quic"
+)
+
+// 节点下线原因分类。
+const (
+	ReasonClientClosed     = "client_closed"     // 节点主动断开
+	ReasonBrokerShutdown   = "broker_shutdown"   // broker 停止运行或排空
+	ReasonAdminKick        = "admin_kick"        // 管理员强制下线
+	ReasonKeepaliveTimeout = "keepalive_timeout" // 心跳超时或主动探测连续失败
+	ReasonTransportError   = "transport_error"   // 通道传输错误
+	ReasonTakeover         = "takeover"          // 节点重新上线，旧连接被新连接接管
+)
+
+// DisconnectReason 节点下线原因，保存在连接历史记录的 reason 字段。
+type DisconnectReason struct {
+	Category string `json:"category"          bson:"category"`          // 原因分类
+	Message  string `json:"message,omitzero"  bson:"message,omitempty"` // 原因描述，如：强制下线的原因
+	Error    string `json:"error,omitzero"    bson:"error,omitempty"`   // 通道断开时的原始错误
+}
+
+// disconnectReason 判断会话的下线原因，err 为通道服务退出时返回的错误。
+//
+// broker 主动断开的会话在断开前已经标记了原因，否则根据错误判断是节点主动断开还是传输出错。
+func disconnectReason(sess *session, err error) DisconnectReason {
+	var reason DisconnectReason
+	if r := sess.reason.Load(); r != nil {
+		reason = *r
+	} else if isClosedError(err) {
+		reason.Category = ReasonClientClosed
+	} else {
+		reason.Category = ReasonTransportError
+	}
+	if err != nil {
+		reason.Error = err.Error()
+	}
+
+	return reason
+}
+
+// isClosedError 是否是节点主动正常关闭通道时返回的错误，只认已知的错误，其余的一律视为传输错误。
+//
+// 各协议对端正常关闭时的错误：
+//   - smux yamux：底层连接读到 io.EOF。
+//   - quic-go：对端以错误码 0 关闭连接（*quic.ApplicationError）。
+//   - x/net/quic：对端以错误码 0 关闭连接（*quic.ApplicationError）。
+//   - websocket：对端发送了正常关闭帧。
+//
+// smux 的 io.ErrClosedPipe、yamux 的 ErrKeepAliveTimeout 等是协议自身检测到对端失联，属于传输错误。
+// yamux.ErrSessionShutdown 是本端关闭会话，broker 主动断开时已经标记了原因，走不到这里。
+func isClosedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, http.ErrServerClosed) || errors.Is(err, yamux.ErrRemoteGoAway) {
+		return true
+	}
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return true
+	}
+
+	var gae *quicgo.ApplicationError
+	if errors.As(err, &gae) {
+		return gae.Remote && gae.ErrorCode == 0
+	}
+	var xae *xquic.ApplicationError
+	if errors.As(err, &xae) {
+		return xae.Code == 0
+	}
+
+	return false
+}
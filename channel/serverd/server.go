@@ -2,14 +2,19 @@ package serverd
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/xmx/aegis-broker/channel/internal/graceful"
+	"github.com/xmx/aegis-broker/outbox"
 	"github.com/xmx/aegis-common/muxlink/muxconn"
-	"github.com/xmx/aegis-common/muxlink/muxproto"
 	"github.com/xmx/aegis-common/muxlink/muxtool"
 	"github.com/xmx/aegis-control/datalayer/model"
 	"github.com/xmx/aegis-control/datalayer/repository"
@@ -18,7 +23,10 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
-func New(repo repository.All, opts Options) muxproto.MUXAccepter {
+// rejectTimeout 拒绝节点上线时等待认证子流与写入拒绝报文的超时时间。
+const rejectTimeout = 3 * time.Second
+
+func New(repo repository.All, opts Options) Server {
 	return &agentServer{
 		repo: repo,
 		opts: opts,
@@ -26,8 +34,10 @@ func New(repo repository.All, opts Options) muxproto.MUXAccepter {
 }
 
 type agentServer struct {
-	repo repository.All
-	opts Options
+	repo     repository.All
+	opts     Options
+	sessions sessionMap
+	draining atomic.Bool
 }
 
 // AcceptMUX 处理连接。
@@ -37,44 +47,50 @@ func (as *agentServer) AcceptMUX(mux muxconn.Muxer) {
 	defer mux.Close()
 
 	connectAt := time.Now()
-	if !as.limitAllowed(mux) {
-		as.log().Warn("限流器抑制上线", "remote_addr", mux.RemoteAddr())
+	if as.draining.Load() {
+		as.log().Warn("broker 排空中，拒绝节点上线", "remote_addr", mux.RemoteAddr())
+		as.rejectDraining(mux)
+		return
+	}
+
+	release, retryAfter, allowed := as.admit(mux)
+	if !allowed {
+		as.log().Warn("限流器抑制上线", "remote_addr", mux.RemoteAddr(), "retry_after", retryAfter)
+		as.rejectAdmission(mux, retryAfter)
+		return
 	}
 
-	peer, err := as.authentication(mux)
+	release = sync.OnceFunc(release)
+	sess, err := as.authentication(mux, connectAt, release)
+	release()
 	if err != nil {
 		raddr := mux.RemoteAddr()
 		as.log().Warn("节点上线失败", "remote_addr", raddr, "error", err)
 		return
 	}
 
+	peer := sess.peer
 	info := peer.Info()
 	as.log().Info("节点上线成功", "info", info)
-	if sh := as.opts.ServerHooker; sh != nil {
-		sh.OnConnected(info, connectAt)
-	}
+	as.onConnected(peer, connectAt)
 
-	err = as.serveHTTP(peer)
+	go as.monitor(sess)
+	err = as.serveHTTP(sess)
 	as.log().Warn("节点下线了", "info", info, "error", err)
 
-	as.disconnection(peer, connectAt)
+	as.disconnection(sess, err)
 }
 
+// release 用于提前释放握手名额，接管旧连接时可能要等待较长时间，不应该一直占用名额。
+//
 //goland:noinspection GoUnhandledErrorResult
-func (as *agentServer) authentication(mux muxconn.Muxer) (linkhub.Peer, error) {
+func (as *agentServer) authentication(mux muxconn.Muxer, connectAt time.Time, release func()) (*session, error) {
 	timeout := as.timeout()
-
-	fc := muxtool.NewFlagCloser(mux)
-	timer := time.AfterFunc(timeout, fc.Close)
-	conn, err := mux.Accept()
-	timer.Stop()
+	conn, err := as.acceptAuth(mux, timeout)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
-	if fc.Closed() {
-		return nil, net.ErrClosed
-	}
 
 	req := new(AuthRequest)
 	_ = conn.SetReadDeadline(time.Now().Add(timeout))
@@ -91,22 +107,61 @@ func (as *agentServer) authentication(mux muxconn.Muxer) (linkhub.Peer, error) {
 		return nil, err
 	}
 
-	agt, err := as.findOrCreateAgent(req)
+	agt, ban, err := as.findAgent(req)
 	if err != nil {
-		as.log().Warn("查询/新增节点错误", "error", err)
-		as.responseError(conn, err, 0)
+		as.log().Warn("查询节点错误", "error", err)
+		as.responseError(conn, err, http.StatusInternalServerError)
 		return nil, err
 	}
 
-	// 在线状态检查
-	if agt.Status {
-		err = errors.New("此节点已经在线了（数据库）")
-		as.log().Warn("节点重复上线（数据库）", attrs...)
-		as.responseError(conn, err, http.StatusConflict)
+	if dat, banned := checkBanned(ban); banned {
+		err = errors.New(dat.Message)
+		attrs = append(attrs, "error", err)
+		as.log().Warn("节点被禁止上线", attrs...)
+		_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+		_ = muxtool.WriteAuth(conn, dat)
+		return nil, err
+	}
 
+	certs := peerCertificates(mux)
+	ret, err := as.authenticate(req, agt != nil, certs)
+	if err != nil {
+		attrs = append(attrs, "error", err)
+		if !errors.Is(err, ErrUnauthorized) {
+			// 数据库等暂时性故障，不能让节点误以为凭据错误。
+			as.log().Error("节点认证出错", attrs...)
+			as.responseError(conn, errors.New("节点认证服务暂不可用，请稍后重试"), http.StatusServiceUnavailable)
+			return nil, err
+		}
+		as.log().Warn("节点认证失败", attrs...)
+		as.responseError(conn, ErrUnauthorized, http.StatusUnauthorized)
 		return nil, err
 	}
 
+	if agt == nil {
+		if agt, err = as.createAgent(req); err != nil {
+			as.log().Warn("新增节点错误", "error", err)
+			as.responseError(conn, err, 0)
+			return nil, err
+		}
+		if ret != nil {
+			ret.Enrolled = true
+		}
+	}
+
+	// 在线状态检查
+	if agt.Status || as.opts.Huber.GetID(agt.ID) != nil {
+		release()
+		if err = as.takeover(agt); err != nil {
+			attrs = append(attrs, "error", err)
+			as.log().Warn("节点重复上线", attrs...)
+			as.responseError(conn, err, http.StatusConflict)
+
+			return nil, err
+		}
+		as.log().Warn("节点旧连接已失联，由新连接接管", attrs...)
+	}
+
 	agentID := agt.ID
 	info := linkhub.Info{
 		Name: req.MachineID, Inet: req.Inet, Goos: req.Goos, Goarch: req.Goarch,
@@ -120,6 +175,7 @@ func (as *agentServer) authentication(mux muxconn.Muxer) (linkhub.Peer, error) {
 
 		return nil, err
 	}
+	as.applyBandwidth(peer)
 
 	if err = as.responseAccepted(conn); err != nil {
 		as.deleteHuber(agentID) // 报文响应失败，从连接池中删除并返回错误。
@@ -132,30 +188,210 @@ func (as *agentServer) authentication(mux muxconn.Muxer) (linkhub.Peer, error) {
 	}
 
 	// 修改数据库在线状态
-	if ret, err2 := as.updateAgentOnline(mux, req, agt); err2 != nil || ret.ModifiedCount == 0 {
+	sess := newSession(peer, connectAt)
+	if res, err2 := as.updateAgentOnline(mux, req, agt, ret, sess.id); err2 != nil || res.ModifiedCount == 0 {
 		as.deleteHuber(agentID) // 修改数据库状态失败，从连接池中删除并返回错误。
 
 		if err2 == nil {
 			err2 = errors.New("没有找到该节点（修改在线状态）")
 		}
-		attrs = append(attrs, "error", err)
-		as.log().Error("节点重复上线（连接池）", attrs...)
+		attrs = append(attrs, "error", err2)
+		as.log().Error("修改节点在线状态失败", attrs...)
 		as.responseError(conn, err2, http.StatusConflict)
 
-		return nil, err
+		return nil, err2
+	}
+	as.sessions.put(sess)
+
+	return sess, nil
+}
+
+// takeover 节点重复上线时尝试接管旧连接。
+//
+// 如果旧连接在当前 broker 的连接池中，先探测其是否存活，存活则拒绝新连接，
+// 否则断开旧连接并等待其下线处理（写入连接历史记录等）完毕。
+// 如果旧连接不在连接池中，但是数据库记录为在线状态，且记录的 broker 就是自己或者租约已经过期，
+// 说明是残留的脏数据，直接将其修正为离线。
+func (as *agentServer) takeover(agt *model.Agent) error {
+	if !as.opts.Takeover {
+		return errors.New("此节点已经在线了")
+	}
+
+	id := agt.ID
+	if old := as.opts.Huber.GetID(id); old != nil {
+		if rtt, err := as.probe(old); err == nil {
+			as.log().Info("节点旧连接仍然存活，拒绝接管", "info", old.Info(), "rtt", rtt)
+			return errors.New("此节点已经在线了（连接池）")
+		}
+
+		sess := as.sessions.get(id)
+		if sess == nil || sess.peer != old {
+			// 旧连接还没有登记会话（或者会话已经被替换），关闭后由旧连接自己的协程将其移出连接池。
+			_ = old.Muxer().Close()
+			if !as.waitRemoved(old, 2*as.timeout()) {
+				return errors.New("等待节点旧连接下线超时")
+			}
+		} else {
+			sess.close(ReasonTakeover, "节点重新上线，旧连接被接管")
+			if !sess.wait(2 * as.timeout()) {
+				return errors.New("等待节点旧连接下线超时")
+			}
+		}
+		if as.opts.Huber.GetID(id) != nil {
+			return errors.New("节点旧连接下线处理未完成")
+		}
+
+		return nil
 	}
 
-	return peer, nil
+	if !agt.Status {
+		return nil
+	}
+	if brk := agt.Broker; brk != nil && brk.ID != as.opts.CurrentBroker.ID {
+		if as.leaseAlive(brk.ID) {
+			return errors.New("此节点已经在线了（其它 broker）")
+		}
+		as.log().Warn("节点所属 broker 租约已过期，接管该节点", "agent_id", id, "broker", brk)
+	}
+
+	return as.resetStale(agt)
 }
 
-func (as *agentServer) limitAllowed(mux muxconn.Muxer) bool {
-	if l := as.opts.Limiter; l != nil {
-		return l(mux)
+// waitRemoved 等待 peer 被移出连接池，超时返回 false。
+func (as *agentServer) waitRemoved(peer linkhub.Peer, timeout time.Duration) bool {
+	const interval = 50 * time.Millisecond
+
+	id := peer.ID()
+	deadline := time.Now().Add(timeout)
+	for as.opts.Huber.GetID(id) == peer {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(interval)
 	}
 
 	return true
 }
 
+// resetStale 修正残留的在线状态，并补写一条连接历史记录。
+//
+// 只有节点仍然属于原 broker 时才会修正，多个 broker 同时接管时只有一个能修正成功。
+func (as *agentServer) resetStale(agt *model.Agent) error {
+	ctx, cancel := as.perContext()
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{"_id": agt.ID, "status": true}
+	if brk := agt.Broker; brk != nil {
+		filter["broker.id"] = brk.ID
+	}
+	update := bson.M{"$set": bson.M{"status": false, "tunnel_stat.disconnected_at": now}}
+	repo := as.repo.Agent()
+	if ret, err := repo.UpdateOne(ctx, filter, update); err != nil {
+		return err
+	} else if ret.ModifiedCount == 0 {
+		return nil // 已经被修正过了
+	}
+
+	stat := agt.TunnelStat
+	if stat == nil {
+		return nil
+	}
+
+	history := &model.AgentConnectHistory{
+		AgentID:   agt.ID,
+		MachineID: agt.MachineID,
+		TunnelStat: model.TunnelStatHistory{
+			ConnectedAt:    stat.ConnectedAt,
+			DisconnectedAt: now,
+			Second:         int64(now.Sub(stat.ConnectedAt).Seconds()),
+			Library:        stat.Library,
+			LocalAddr:      stat.LocalAddr,
+			RemoteAddr:     stat.RemoteAddr,
+			ReceiveBytes:   stat.ReceiveBytes,
+			TransmitBytes:  stat.TransmitBytes,
+		},
+	}
+	if exe := agt.ExecuteStat; exe != nil {
+		history.Semver, history.Inet = exe.Semver, exe.Inet
+		history.Goos, history.Goarch = exe.Goos, exe.Goarch
+	}
+	hisRepo := as.repo.AgentConnectHistory()
+	if _, err := hisRepo.InsertOne(ctx, history); err != nil {
+		as.log().Error("保存残留连接历史记录错误", "agent_id", agt.ID, "error", err)
+	}
+
+	return nil
+}
+
+// acceptAuth 接收节点打开的认证子流，超过 timeout 没有打开则关闭连接。
+func (as *agentServer) acceptAuth(mux muxconn.Muxer, timeout time.Duration) (net.Conn, error) {
+	fc := muxtool.NewFlagCloser(mux)
+	timer := time.AfterFunc(timeout, fc.Close)
+	conn, err := mux.Accept()
+	timer.Stop()
+	if err != nil {
+		return nil, err
+	}
+	if fc.Closed() {
+		_ = conn.Close()
+		return nil, net.ErrClosed
+	}
+
+	return conn, nil
+}
+
+func (as *agentServer) admit(mux muxconn.Muxer) (func(), time.Duration, bool) {
+	l := as.opts.Limiter
+	if l == nil {
+		return func() {}, 0, true
+	}
+
+	release, retryAfter, allowed := l.Admit(mux)
+	if allowed && release == nil {
+		release = func() {}
+	}
+
+	return release, retryAfter, allowed
+}
+
+// rejectAdmission 拒绝节点上线，响应 429 并告知节点多久之后再重试。
+func (as *agentServer) rejectAdmission(mux muxconn.Muxer, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	dat := &authResponse{
+		Code:       http.StatusTooManyRequests,
+		Message:    "节点上线请求过多，请稍后重试",
+		RetryAfter: max(seconds, 1),
+	}
+	as.reject(mux, dat)
+}
+
+// rejectDraining 拒绝节点上线，响应 503 让节点连接其它 broker。
+func (as *agentServer) rejectDraining(mux muxconn.Muxer) {
+	dat := &authResponse{
+		Code:    http.StatusServiceUnavailable,
+		Message: "broker 维护中，请连接其它 broker",
+	}
+	as.reject(mux, dat)
+}
+
+// reject 在认证子流上直接响应拒绝报文，不读取认证报文。
+//
+// 被拒绝的连接不占用握手名额，所以使用较短的超时时间，避免大量被拒绝的连接长时间占用资源。
+//
+//goland:noinspection GoUnhandledErrorResult
+func (as *agentServer) reject(mux muxconn.Muxer, dat *authResponse) {
+	timeout := min(as.timeout(), rejectTimeout)
+	conn, err := as.acceptAuth(mux, timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+	_ = muxtool.WriteAuth(conn, dat)
+}
+
 func (as *agentServer) log() *slog.Logger {
 	if l := as.opts.Logger; l != nil {
 		return l
@@ -164,15 +400,20 @@ func (as *agentServer) log() *slog.Logger {
 	return slog.Default()
 }
 
-func (as *agentServer) disconnection(peer linkhub.Peer, connectAt time.Time) {
+func (as *agentServer) disconnection(sess *session, err error) {
+	defer close(sess.done)
+	defer as.sessions.del(sess)
+
+	peer, connectAt := sess.peer, sess.connectAt
 	disconnectAt := time.Now()
 	id := peer.ID()
 	info := peer.Info()
 	mux := peer.Muxer()
 	tx, rx := mux.Traffic() // 互换
 
-	attrs := []any{"info", info}
-	filter := bson.D{{"_id", id}, {"status", true}}
+	reason := disconnectReason(sess, err)
+	attrs := []any{"info", info, "reason", reason}
+	filter := bson.M{"_id": id, "status": true, "session_id": sess.id}
 	update := bson.M{"$set": bson.M{
 		"status": false, "tunnel_stat.disconnected_at": disconnectAt,
 		"tunnel_stat.receive_bytes": rx, "tunnel_stat.transmit_bytes": tx,
@@ -182,20 +423,20 @@ func (as *agentServer) disconnection(peer linkhub.Peer, connectAt time.Time) {
 	ctx, cancel := as.perContext()
 	defer cancel()
 
-	repo := as.repo.Agent()
-	if ret, err := repo.UpdateOne(ctx, filter, update); err != nil {
+	agentColl := as.repo.Agent().Collection().Name()
+	if err := as.writer().Write(ctx, outbox.UpdateOne(agentColl, filter, update)); err != nil {
 		attrs = append(attrs, "error", err)
 		as.log().Error("修改数据库节点下线状态错误", attrs...)
-	} else if ret.ModifiedCount == 0 {
-		as.log().Error("修改数据库节点下线状态无修改", attrs...)
 	}
 
-	as.deleteHuber(id)
+	as.deletePeer(peer)
 
 	libName, libModule := mux.Library()
 	raddr, laddr := mux.Addr(), mux.RemoteAddr() // 互换
 	second := int64(disconnectAt.Sub(connectAt).Seconds())
-	history := &model.AgentConnectHistory{
+	history := &connectHistory{Reason: reason}
+	history.AgentConnectHistory = model.AgentConnectHistory{
+		ID:        bson.NewObjectID(), // 事先生成 ID，发件箱重放时不会重复插入。
 		AgentID:   id,
 		MachineID: info.Name,
 		Semver:    info.Semver,
@@ -213,17 +454,24 @@ func (as *agentServer) disconnection(peer linkhub.Peer, connectAt time.Time) {
 			TransmitBytes:  tx,
 		},
 	}
-	hisRepo := as.repo.AgentConnectHistory()
-	if _, err := hisRepo.InsertOne(ctx, history); err != nil {
+	hisColl := as.repo.AgentConnectHistory().Collection().Name()
+	if err := as.writer().Write(ctx, outbox.InsertOne(hisColl, history)); err != nil {
 		attrs = append(attrs, "save_history_error", err)
 		as.log().Error("保存连接历史记录错误", attrs...)
 	}
 
 	as.log().Info("节点下线处理完毕", attrs...)
 
-	if sh := as.opts.ServerHooker; sh != nil {
-		sh.OnDisconnected(info, connectAt, disconnectAt)
+	as.onDisconnected(peer, connectAt, disconnectAt, reason)
+}
+
+// writer 节点上下线状态与连接历史记录的写入器，未配置发件箱时直接写入数据库。
+func (as *agentServer) writer() outbox.Writer {
+	if w := as.opts.Outbox; w != nil {
+		return w
 	}
+
+	return outbox.Direct(as.repo.DB())
 }
 
 func (as *agentServer) timeout() time.Duration {
@@ -236,10 +484,7 @@ func (as *agentServer) timeout() time.Duration {
 
 func (as *agentServer) perContext() (context.Context, context.CancelFunc) {
 	du := as.timeout()
-	ctx := as.opts.Context
-	if ctx == nil {
-		ctx = context.Background()
-	}
+	ctx := as.baseContext()
 
 	return context.WithTimeout(ctx, du)
 }
@@ -274,25 +519,67 @@ func (as *agentServer) responseAccepted(conn net.Conn) error {
 	return muxtool.WriteAuth(conn, dat)
 }
 
-// checkout 获得 agent 节点的信息，如果不存在自动创建。
-func (as *agentServer) findOrCreateAgent(req *AuthRequest) (*model.Agent, error) {
-	machineID := req.MachineID
-	repo := as.repo.Agent()
+// authenticate 认证节点，未配置认证器时视为认证通过。
+func (as *agentServer) authenticate(req *AuthRequest, registered bool, certs []*x509.Certificate) (*AuthResult, error) {
+	auth := as.opts.Authenticator
+	if auth == nil {
+		return nil, nil
+	}
 
 	ctx, cancel := as.perContext()
 	defer cancel()
 
-	filter := bson.D{{"machine_id", machineID}}
-	agt, err := repo.FindOne(ctx, filter)
-	if err == nil {
-		return agt, nil
-	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+	sub := &AuthSubject{Request: req, Registered: registered, Certificates: certs}
+	ret, err := auth.Authenticate(ctx, sub)
+	if err != nil {
 		return nil, err
+	} else if ret == nil {
+		return nil, ErrUnauthorized
+	}
+
+	return ret, nil
+}
+
+// findAgent 查询 agent 节点的信息及其上线封禁，如果不存在返回 nil。
+func (as *agentServer) findAgent(req *AuthRequest) (*model.Agent, *agentBan, error) {
+	coll := as.repo.Agent().Collection()
+
+	ctx, cancel := as.perContext()
+	defer cancel()
+
+	filter := bson.M{"machine_id": req.MachineID}
+	raw, err := coll.FindOne(ctx, filter).Raw()
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	agt := new(model.Agent)
+	if err = bson.Unmarshal(raw, agt); err != nil {
+		return nil, nil, err
 	}
+	var ext struct {
+		Ban *agentBan `bson:"ban"`
+	}
+	if err = bson.Unmarshal(raw, &ext); err != nil {
+		return nil, nil, err
+	}
+
+	return agt, ext.Ban, nil
+}
+
+// createAgent 注册新的 agent 节点。
+func (as *agentServer) createAgent(req *AuthRequest) (*model.Agent, error) {
+	repo := as.repo.Agent()
+
+	ctx, cancel := as.perContext()
+	defer cancel()
 
 	now := time.Now()
 	data := &model.Agent{
-		MachineID: machineID,
+		MachineID: req.MachineID,
 		Status:    false, // 新增时默认离线状态
 		CreatedAt: now,
 		UpdatedAt: now,
@@ -307,7 +594,7 @@ func (as *agentServer) findOrCreateAgent(req *AuthRequest) (*model.Agent, error)
 	return data, nil
 }
 
-func (as *agentServer) updateAgentOnline(mux muxconn.Muxer, req *AuthRequest, agt *model.Agent) (*mongo.UpdateResult, error) {
+func (as *agentServer) updateAgentOnline(mux muxconn.Muxer, req *AuthRequest, agt *model.Agent, auth *AuthResult, sessionID bson.ObjectID) (*mongo.UpdateResult, error) {
 	// 修改数据库在线状态
 	now := time.Now()
 	id := agt.ID
@@ -339,19 +626,44 @@ func (as *agentServer) updateAgentOnline(mux muxconn.Muxer, req *AuthRequest, ag
 		Name: as.opts.CurrentBroker.Name,
 	}
 
-	update := bson.M{"$set": bson.M{
+	sets := bson.M{
 		"status": true, "tunnel_stat": tunStat, "execute_stat": exeStat, "broker": point,
-	}}
-	filter := bson.D{{"_id", id}, {"status", false}}
+		"session_id": sessionID,
+	}
+	if auth != nil {
+		sets["authentication"] = auth
+	}
+	update := bson.M{"$set": sets}
+	filter := bson.M{"_id": id, "status": false}
 
 	ctx, cancel := as.perContext()
 	defer cancel()
 
+	// 上线时需要根据修改结果判断是否被并发上线抢先，所以不经过发件箱，
+	// 而且数据库不可用时节点认证也无法完成。
 	repo := as.repo.Agent()
 
 	return repo.UpdateOne(ctx, filter, update)
 }
 
+// applyBandwidth 按照带宽策略为节点通道限速，查询策略出错时不限速。
+func (as *agentServer) applyBandwidth(peer linkhub.Peer) {
+	bw := as.opts.Bandwidth
+	if bw == nil {
+		return
+	}
+
+	ctx, cancel := as.perContext()
+	defer cancel()
+
+	limit, err := bw.Bandwidth(ctx, peer.ID())
+	if err != nil {
+		as.log().Warn("查询节点带宽策略错误", "info", peer.Info(), "error", err)
+		return
+	}
+	peer.Muxer().SetLimit(limit)
+}
+
 func (as *agentServer) putHuber(id bson.ObjectID, mux muxconn.Muxer, inf linkhub.Info) linkhub.Peer {
 	return as.opts.Huber.Put(id, mux, inf)
 }
@@ -360,19 +672,38 @@ func (as *agentServer) deleteHuber(id bson.ObjectID) {
 	as.opts.Huber.DelID(id)
 }
 
-func (as *agentServer) serveHTTP(peer linkhub.Peer) error {
+// deletePeer 从连接池中删除节点，只有连接池中的节点就是 peer 时才会删除，
+// 避免误删接管后的新连接。
+func (as *agentServer) deletePeer(peer linkhub.Peer) {
+	id := peer.ID()
+	if as.opts.Huber.GetID(id) == peer {
+		as.deleteHuber(id)
+	}
+}
+
+func (as *agentServer) baseContext() context.Context {
+	if ctx := as.opts.Context; ctx != nil {
+		return ctx
+	}
+
+	return context.Background()
+}
+
+func (as *agentServer) serveHTTP(sess *session) error {
 	h := as.opts.Handler
 	if h == nil {
 		h = http.NotFoundHandler()
 	}
 
+	peer := sess.peer
 	srv := &http.Server{
 		Handler: h,
 		BaseContext: func(net.Listener) context.Context {
 			return linkhub.WithValue(context.Background(), peer)
 		},
 	}
+	sess.srv.Store(srv)
 	mux := peer.Muxer()
 
-	return srv.Serve(mux)
+	return srv.Serve(graceful.NewListener(mux))
 }
@@ -0,0 +1,117 @@
+package serverd
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xmx/aegis-control/linkhub"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// session 节点在当前 broker 上的一次连接会话。
+type session struct {
+	id        bson.ObjectID // 会话 ID，会保存在节点数据的 session_id 字段，用于区分新旧连接。
+	peer      linkhub.Peer
+	connectAt time.Time
+	keepalive atomic.Int64                     // 最近一次心跳时间（UnixNano）
+	reason    atomic.Pointer[DisconnectReason] // broker 主动断开的原因，为空说明不是 broker 主动断开的。
+	srv       atomic.Pointer[http.Server]      // 处理节点请求的 http 服务
+	rtt       atomic.Int64                     // 最近一次主动探测的 RTT，没有探测过为 0。
+	done      chan struct{}                    // 会话下线处理完毕后关闭
+}
+
+func newSession(peer linkhub.Peer, connectAt time.Time) *session {
+	s := &session{
+		id:        bson.NewObjectID(),
+		peer:      peer,
+		connectAt: connectAt,
+		done:      make(chan struct{}),
+	}
+	s.keepalive.Store(connectAt.UnixNano())
+
+	return s
+}
+
+func (s *session) stat() SessionStat {
+	return SessionStat{
+		ID:          s.id,
+		Peer:        s.peer,
+		ConnectAt:   s.connectAt,
+		KeepaliveAt: time.Unix(0, s.keepalive.Load()),
+		RTT:         time.Duration(s.rtt.Load()),
+	}
+}
+
+// mark 标记 broker 主动断开的原因，只有第一次标记的原因有效。
+func (s *session) mark(category, message string) {
+	s.reason.CompareAndSwap(nil, &DisconnectReason{Category: category, Message: message})
+}
+
+// close 标记 broker 主动断开的原因并断开通道。
+func (s *session) close(category, message string) {
+	s.mark(category, message)
+	_ = s.peer.Muxer().Close()
+}
+
+// wait 等待会话下线处理完毕，超时返回 false。
+func (s *session) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+type sessionMap struct {
+	mutex    sync.RWMutex
+	sessions map[bson.ObjectID]*session
+}
+
+func (sm *sessionMap) get(agentID bson.ObjectID) *session {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	return sm.sessions[agentID]
+}
+
+func (sm *sessionMap) all() []*session {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	ret := make([]*session, 0, len(sm.sessions))
+	for _, s := range sm.sessions {
+		ret = append(ret, s)
+	}
+
+	return ret
+}
+
+func (sm *sessionMap) put(s *session) {
+	id := s.peer.ID()
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if sm.sessions == nil {
+		sm.sessions = make(map[bson.ObjectID]*session, 16)
+	}
+	sm.sessions[id] = s
+}
+
+// del 删除会话，只有当前登记的会话就是 s 时才会删除。
+func (sm *sessionMap) del(s *session) {
+	id := s.peer.ID()
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if sm.sessions[id] == s {
+		delete(sm.sessions, id)
+	}
+}
@@ -0,0 +1,47 @@
+package serverd
+
+import (
+	"context"
+	"sync"
+)
+
+// Shutdown 优雅关闭：拒绝新节点上线，等待每个节点通道上正在处理的请求完成后断开，
+// 并等待下线处理（修改在线状态、写入连接历史记录）完毕。
+//
+// ctx 超时后不再等待请求完成，直接断开节点通道，但仍然会等待下线处理完毕。
+func (as *agentServer) Shutdown(ctx context.Context) error {
+	as.draining.Store(true)
+
+	sessions := as.sessions.all()
+	as.log().Warn("开始关闭节点通道", "count", len(sessions))
+
+	var wg sync.WaitGroup
+	for _, sess := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			as.shutdownSession(ctx, sess)
+		}()
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+func (as *agentServer) shutdownSession(ctx context.Context, sess *session) {
+	const message = "broker 停止运行"
+	attrs := []any{"info", sess.peer.Info()}
+	// http 服务关闭后节点通道随即下线，要在关闭前标记原因。
+	sess.mark(ReasonBrokerShutdown, message)
+	if srv := sess.srv.Load(); srv != nil {
+		if err := srv.Shutdown(ctx); err != nil {
+			attrs = append(attrs, "error", err)
+			as.log().Warn("节点通道上的请求未能在期限内完成", attrs...)
+		}
+	}
+
+	sess.close(ReasonBrokerShutdown, message)
+	if !sess.wait(2 * as.timeout()) {
+		as.log().Warn("等待节点下线处理超时", attrs...)
+	}
+}
@@ -0,0 +1,108 @@
+package config
+
+import "github.com/xmx/aegis-control/datalayer/model"
+
+// Boot 中心端下发的 broker 运行配置，对应数据库 broker 文档中的 config 字段。
+//
+// model.BrokerConfig 为公共模块定义的通用配置，broker 独有的配置在此扩展。
+type Boot struct {
+	model.BrokerConfig `bson:",inline"`
+
+	Auth      BootAuth      `json:"auth"      bson:"auth"`
+	Admission BootAdmission `json:"admission" bson:"admission"`
+	Tracing   BootTracing   `json:"tracing"   bson:"tracing"`
+	Artifact  BootArtifact  `json:"artifact"  bson:"artifact"`
+	Download  BootDownload  `json:"download"  bson:"download"`
+	Bandwidth BootBandwidth `json:"bandwidth" bson:"bandwidth"`
+	Shutdown  BootShutdown  `json:"shutdown"  bson:"shutdown"`
+	Keepalive BootKeepalive `json:"keepalive" bson:"keepalive"`
+	Liveness  BootLiveness  `json:"liveness"  bson:"liveness"`
+	Outbox    BootOutbox    `json:"outbox"    bson:"outbox"`
+}
+
+// BootAuth 节点认证配置。
+type BootAuth struct {
+	// Methods 认证方式，可选值：token secret certificate，任意一种认证通过即可。
+	// 为空时不认证，任意节点均可注册上线。
+	Methods []string `json:"methods" bson:"methods" validate:"omitempty,unique,dive,oneof=token secret certificate"`
+
+	// Tokens 注册令牌（令牌名 -> 令牌值），methods 包含 token 时生效。
+	Tokens map[string]string `json:"-" bson:"tokens"`
+}
+
+// BootAdmission 节点上线准入控制配置，避免 broker 重启后节点集中重连压垮数据库。
+type BootAdmission struct {
+	Rate          float64        `json:"rate"           bson:"rate"           validate:"gte=0"`         // 每个网段每秒允许的握手次数，0 代表不限制。
+	Burst         int            `json:"burst"          bson:"burst"          validate:"gte=0"`         // 每个网段的令牌桶容量。
+	IPv4Prefix    int            `json:"ipv4_prefix"    bson:"ipv4_prefix"    validate:"gte=0,lte=32"`  // IPv4 网段掩码长度，默认 32。
+	IPv6Prefix    int            `json:"ipv6_prefix"    bson:"ipv6_prefix"    validate:"gte=0,lte=128"` // IPv6 网段掩码长度，默认 64。
+	MaxHandshakes int            `json:"max_handshakes" bson:"max_handshakes" validate:"gte=0"`         // 全局最大并发握手数，0 代表不限制。
+	RetryAfter    model.Duration `json:"retry_after"    bson:"retry_after"`                             // 超出并发握手数时建议节点等待的时长。
+}
+
+// BootTracing 链路追踪（OpenTelemetry OTLP）配置，Endpoint 为空时不上报。
+type BootTracing struct {
+	// Endpoint 上报地址，例如：tempo.example.com:4318 或 https://tempo.example.com/v1/traces
+	Endpoint string `json:"endpoint" bson:"endpoint"`
+
+	// Protocol 上报协议，可选值：http grpc，默认 http。
+	Protocol string `json:"protocol" bson:"protocol" validate:"omitempty,oneof=http grpc"`
+
+	// Insecure 是否使用明文传输。
+	Insecure bool `json:"insecure" bson:"insecure"`
+
+	// Headers 上报时附带的请求头，例如：X-Scope-OrgID Authorization。
+	Headers map[string]string `json:"-" bson:"headers"`
+
+	// SampleRatio 采样率，取值范围 [0, 1]，0 代表不采样，未配置时全部采样。
+	SampleRatio *float64 `json:"sample_ratio,omitempty" bson:"sample_ratio,omitempty" validate:"omitnil,gte=0,lte=1"`
+}
+
+// BootArtifact 节点升级包本地缓存配置。
+type BootArtifact struct {
+	Dir     string `json:"dir"      bson:"dir"`                       // 缓存目录，默认 resources/artifact
+	MaxSize int64  `json:"max_size" bson:"max_size" validate:"gte=0"` // 缓存目录最大字节数，0 代表不限制。
+}
+
+// BootDownload 节点升级包下载调度配置，避免全网升级时占满 broker 的上行带宽。
+type BootDownload struct {
+	Rate         int64          `json:"rate"          bson:"rate"          validate:"gte=0"` // 所有下载合计的带宽上限（KiB/s），0 代表不限制。
+	Concurrent   int            `json:"concurrent"    bson:"concurrent"    validate:"gte=0"` // 最大并发下载数，0 代表不限制。
+	Queue        int            `json:"queue"         bson:"queue"         validate:"gte=0"` // 超出并发数后最多排队的任务数，0 代表不限制。
+	QueueTimeout model.Duration `json:"queue_timeout" bson:"queue_timeout"`                  // 排队最长等待时长，0 代表一直等到请求取消。
+}
+
+// BootBandwidth 通道带宽策略，单个节点的带宽上限保存在 agent 文档的 bandwidth 字段，优先级高于此处的默认值。
+type BootBandwidth struct {
+	Broker int64 `json:"broker" bson:"broker" validate:"gte=0"` // broker 连接中心端的通道带宽上限（KiB/s），0 代表不限制。
+	Agent  int64 `json:"agent"  bson:"agent"  validate:"gte=0"` // 节点通道默认的带宽上限（KiB/s），0 代表不限制。
+}
+
+// BootShutdown 停止运行时的优雅关闭配置。
+type BootShutdown struct {
+	Grace model.Duration `json:"grace" bson:"grace" validate:"gte=0"` // 等待正在处理的请求完成的最长时间，默认 30s。
+	Drain model.Duration `json:"drain" bson:"drain" validate:"gte=0"` // 收到 SIGTERM 时等待节点迁移的最长时间，默认 1m，与 grace 之和应小于 systemd 的 TimeoutStopSec。
+}
+
+// BootKeepalive 节点心跳配置。
+//
+// 节点心跳默认只记录在内存中，定期批量写入数据库，避免大量节点心跳时每次都写数据库。
+type BootKeepalive struct {
+	WriteThrough bool           `json:"write_through" bson:"write_through"`                  // 每次心跳都立即写入数据库。
+	Interval     model.Duration `json:"interval"      bson:"interval"      validate:"gte=0"` // 批量写入数据库的间隔，默认 10s，修改后重启生效。
+	Timeout      model.Duration `json:"timeout"       bson:"timeout"       validate:"gte=0"` // 超过该时长没有心跳则断开节点通道，0 代表不检查。
+}
+
+// BootLiveness 节点通道主动探测配置，修改后重启生效。
+type BootLiveness struct {
+	Interval model.Duration `json:"interval" bson:"interval" validate:"gte=0"` // 探测间隔，0 代表不主动探测。
+	Failures int            `json:"failures" bson:"failures" validate:"gte=0"` // 连续失败多少次后断开节点通道，默认 3。
+}
+
+// BootOutbox 数据库写操作发件箱配置，修改后重启生效。
+//
+// 数据库不可用时，节点下线状态、连接历史记录、心跳与流量统计等写操作暂存在本地，数据库恢复后按顺序重放。
+type BootOutbox struct {
+	Dir     string `json:"dir"      bson:"dir"`                       // 发件箱目录，默认 resources/outbox
+	MaxSize int64  `json:"max_size" bson:"max_size" validate:"gte=0"` // 发件箱最大字节数，默认 64MiB，超过后丢弃新的写操作。
+}
@@ -1,9 +1,20 @@
 package config
 
+import "github.com/xmx/aegis-control/datalayer/model"
+
 type Config struct {
-	Secret    string   `json:"secret,omitzero"    validate:"required,lte=1000"`
-	Semver    string   `json:"semver,omitzero"    validate:"omitempty,semver"`
-	Protocols []string `json:"protocols,omitzero" validate:"omitempty,lte=4,unique,dive,oneof=quic quic-go smux yamux"`
-	Addresses []string `json:"addresses,omitzero" validate:"lte=100"`
-	Offset    int64    `json:"offset,omitzero"`
+	Secret    string   `json:"secret,omitzero"     validate:"required,lte=1000"`
+	Semver    string   `json:"semver,omitzero"     validate:"omitempty,semver"`
+	Protocols []string `json:"protocols,omitzero"  validate:"omitempty,lte=4,unique,dive,oneof=quic quic-go smux yamux"`
+	Addresses []string `json:"addresses,omitzero"  validate:"lte=100"`
+	Offset    int64    `json:"offset,omitzero"`                                 // 隐写配置在可执行文件中的偏移量，即原始程序的大小。
+	PublicKey string   `json:"public_key,omitzero" validate:"omitempty,base64"` // 升级包签名公钥（ed25519），配置后升级包必须带有合法的签名。
+	Backoff   Backoff  `json:"backoff,omitzero"`                                // 连接中心端断线重连的退避策略。
+}
+
+// Backoff 连接中心端断线重连的指数退避策略，重试等待时长在退避上限内随机，避免大量 broker 同时重连。
+type Backoff struct {
+	Min    model.Duration `json:"min,omitzero"    validate:"gte=0"` // 首次重试的最长等待时长，默认 1s。
+	Max    model.Duration `json:"max,omitzero"    validate:"gte=0"` // 等待时长的上限，默认 1m。
+	Stable model.Duration `json:"stable,omitzero" validate:"gte=0"` // 连接保持超过该时长视为稳定，断线后从头开始退避，默认 1m。
 }
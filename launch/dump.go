@@ -0,0 +1,32 @@
+package launch
+
+import (
+	"bytes"
+	"log/slog"
+	"runtime"
+	"runtime/pprof"
+
+	"github.com/xmx/aegis-broker/application/business"
+	"github.com/xmx/aegis-broker/channel/clientd"
+	"github.com/xmx/aegis-broker/outbox"
+)
+
+// dumpState 导出协程堆栈、中心端通道与节点通道的状态到日志，用于排查卡死、泄漏等问题。
+func dumpState(mux clientd.Muxer, tunnel *business.Tunnel, ob *outbox.Outbox, log *slog.Logger) {
+	buf := new(bytes.Buffer)
+	_ = pprof.Lookup("goroutine").WriteTo(buf, 1)
+	log.Warn("协程状态", "count", runtime.NumGoroutine(), "stack", buf.String())
+
+	rx, tx := mux.Traffic()
+	cumulative, active := mux.NumStreams()
+	log.Warn("中心端通道状态", "state", mux.State(), "remote_addr", mux.RemoteAddr(), "receive_bytes", rx, "transmit_bytes", tx,
+		"cumulative_streams", cumulative, "active_streams", active)
+
+	log.Warn("数据库写操作发件箱状态", "stat", ob.Stat())
+
+	stats := tunnel.Stats()
+	for _, stat := range stats {
+		log.Warn("节点通道状态", "stat", stat)
+	}
+	log.Warn("节点通道状态导出完毕", "count", len(stats))
+}
@@ -0,0 +1,132 @@
+package launch
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/xmx/aegis-control/quick"
+)
+
+// listener 对外暴露的 http 与 quic 服务，监听地址变化时可以重新绑定。
+type listener struct {
+	newHTTP func(addr string) *http.Server
+	newQUIC func(addr string) quick.Server
+	parent  context.Context
+	log     *slog.Logger
+	errs    chan error // 当前在用的服务异常退出时发送错误
+
+	mutex  sync.Mutex
+	addr   string
+	gen    uint64 // 每次绑定自增，用于区分新旧服务
+	http   *http.Server
+	quic   quick.Server
+	cancel context.CancelFunc
+}
+
+func newListener(parent context.Context, newHTTP func(string) *http.Server, newQUIC func(string) quick.Server, log *slog.Logger) *listener {
+	return &listener{
+		newHTTP: newHTTP,
+		newQUIC: newQUIC,
+		parent:  parent,
+		log:     log,
+		errs:    make(chan error, 2),
+	}
+}
+
+// Errors 服务异常退出的错误，只有当前在用的服务才会发送，重新绑定时关闭的旧服务不会发送。
+func (l *listener) Errors() <-chan error {
+	return l.errs
+}
+
+// Bind 监听指定的地址，如果已经在监听其它地址，会先监听新地址再关闭旧的服务。
+// 新地址 tcp 监听失败时保持旧的服务不变。
+func (l *listener) Bind(addr string) error {
+	if addr == "" {
+		addr = ":443"
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.http != nil && l.addr == addr {
+		return nil
+	}
+
+	lc := new(net.ListenConfig)
+	lc.SetMultipathTCP(true)
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		l.log.Error("http 服务监听失败", "listen", addr, "error", err)
+		return err
+	}
+	l.log.Warn("http 服务监听成功", "listen", ln.Addr().String())
+
+	l.closeLocked()
+
+	l.gen++
+	gen := l.gen
+	ctx, cancel := context.WithCancel(l.parent)
+	httpSrv, quicSrv := l.newHTTP(addr), l.newQUIC(addr)
+	l.addr, l.http, l.quic, l.cancel = addr, httpSrv, quicSrv, cancel
+
+	go func() { l.report(gen, httpSrv.ServeTLS(ln, "", "")) }()
+	go func() { l.report(gen, quicSrv.ListenAndServe(ctx)) }()
+
+	return nil
+}
+
+// Shutdown 优雅关闭 http 服务，不再接受新的连接，已经升级为节点通道的 websocket 连接不受影响。
+//
+// quic 服务关闭时会断开所有的节点通道，所以需要等节点通道关闭后再调用 Close。
+func (l *listener) Shutdown(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.gen++
+	if l.http == nil {
+		return nil
+	}
+
+	return l.http.Shutdown(ctx)
+}
+
+// Close 关闭当前的服务。
+func (l *listener) Close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.gen++
+	l.closeLocked()
+}
+
+func (l *listener) closeLocked() {
+	if l.cancel != nil {
+		l.cancel()
+	}
+	if l.http != nil {
+		_ = l.http.Close()
+	}
+	if l.quic != nil {
+		_ = l.quic.Close()
+	}
+	l.http, l.quic, l.cancel = nil, nil, nil
+}
+
+func (l *listener) report(gen uint64, err error) {
+	l.mutex.Lock()
+	current := gen == l.gen
+	l.mutex.Unlock()
+
+	if !current {
+		l.log.Info("旧的监听服务已退出", "error", err)
+		return
+	}
+
+	select {
+	case l.errs <- err:
+	default:
+	}
+}
@@ -0,0 +1,121 @@
+package launch
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/xmx/aegis-common/logger"
+	"github.com/xmx/aegis-control/datalayer/model"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logOutput 日志输出，支持按照新的配置热加载。
+type logOutput struct {
+	opts    *slog.HandlerOptions
+	level   *slog.LevelVar
+	multi   logger.Handler
+	mutex   sync.Mutex
+	lumber  *lumberjack.Logger
+	console bool // 是否输出到控制台
+	applied bool // 是否已经应用过配置
+}
+
+func newLogOutput(multi logger.Handler, opts *slog.HandlerOptions) *logOutput {
+	level := new(slog.LevelVar)
+	opts.Level = level
+
+	return &logOutput{
+		opts:  opts,
+		level: level,
+		multi: multi,
+	}
+}
+
+// apply 应用日志配置：修改日志级别，日志输出有变化时替换日志输出。
+//
+// lumberjack 关闭后后台协程不会退出，仍在使用旧 Handler 的日志写入时还会重新打开文件，
+// 所以只有日志文件的配置变化时才替换 lumberjack，只修改日志级别时不替换日志输出。
+func (lo *logOutput) apply(lc model.BrokerLoggerConfig) {
+	lo.mutex.Lock()
+	defer lo.mutex.Unlock()
+
+	if err := lo.level.UnmarshalText([]byte(lc.Level)); err != nil {
+		lo.level.Set(slog.LevelInfo)
+	}
+
+	sameFile := sameLogFile(lo.lumber, lc)
+	if lo.applied && sameFile && lo.console == lc.Console {
+		return
+	}
+
+	var hs []slog.Handler
+	if lc.Console {
+		tint := logger.NewTint(os.Stdout, lo.opts)
+		hs = append(hs, tint)
+	}
+
+	lumber := lo.lumber
+	if !sameFile {
+		lumber = nil
+		if lc.Filename != "" {
+			lumber = &lumberjack.Logger{
+				Filename:   lc.Filename,
+				MaxSize:    lc.MaxSize,
+				MaxAge:     lc.MaxAge,
+				MaxBackups: lc.MaxBackups,
+				LocalTime:  lc.LocalTime,
+				Compress:   lc.Compress,
+			}
+		}
+	}
+	if lumber != nil {
+		lh := slog.NewJSONHandler(lumber, lo.opts)
+		hs = append(hs, lh)
+	}
+
+	lo.multi.Replace(hs...)
+	if old := lo.lumber; old != nil && old != lumber {
+		_ = old.Close()
+	}
+	lo.lumber = lumber
+	lo.console = lc.Console
+	lo.applied = true
+}
+
+// sameLogFile 日志文件的配置是否与正在使用的 lumberjack 一致，都没有日志文件也视为一致。
+func sameLogFile(lumber *lumberjack.Logger, lc model.BrokerLoggerConfig) bool {
+	if lumber == nil {
+		return lc.Filename == ""
+	}
+
+	return lumber.Filename == lc.Filename &&
+		lumber.MaxSize == lc.MaxSize &&
+		lumber.MaxAge == lc.MaxAge &&
+		lumber.MaxBackups == lc.MaxBackups &&
+		lumber.LocalTime == lc.LocalTime &&
+		lumber.Compress == lc.Compress
+}
+
+func (lo *logOutput) Close() error {
+	lo.mutex.Lock()
+	defer lo.mutex.Unlock()
+
+	if lumber := lo.lumber; lumber != nil {
+		return lumber.Close()
+	}
+
+	return nil
+}
+
+// rotate 轮转日志文件，配合 logrotate 等外部工具使用。
+func (lo *logOutput) rotate() error {
+	lo.mutex.Lock()
+	defer lo.mutex.Unlock()
+
+	if lumber := lo.lumber; lumber != nil {
+		return lumber.Rotate()
+	}
+
+	return nil
+}
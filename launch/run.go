@@ -3,10 +3,15 @@ package launch
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"sync"
 	"time"
 
 	quicgo "github.com/quic-go/quic-go"
@@ -25,6 +30,8 @@ import (
 	"github.com/xmx/aegis-broker/channel/rpclient"
 	"github.com/xmx/aegis-broker/channel/serverd"
 	"github.com/xmx/aegis-broker/config"
+	"github.com/xmx/aegis-broker/outbox"
+	"github.com/xmx/aegis-broker/supervisor"
 	"github.com/xmx/aegis-common/banner"
 	"github.com/xmx/aegis-common/library/cronv3"
 	"github.com/xmx/aegis-common/library/validation"
@@ -41,14 +48,7 @@ import (
 	"github.com/xmx/aegis-control/quick"
 	"github.com/xmx/aegis-control/tlscert"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
-	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.38.0"
 	"golang.org/x/net/quic"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 func Run(ctx context.Context, cfg string) error {
@@ -63,11 +63,49 @@ func Run(ctx context.Context, cfg string) error {
 	return Exec(ctx, cfr)
 }
 
-func Exec(ctx context.Context, crd profile.Reader[config.Config]) error {
+// Exec 运行 broker，直至 parent 取消、排空完毕或者需要重启。
+//
+// 升级、回滚、重启指令都会先优雅关闭，全部资源释放完毕后再由 supervisor 重启进程。
+func Exec(parent context.Context, crd profile.Reader[config.Config]) error {
+	sup := supervisor.Detect("aegis-broker.service")
+	for {
+		err := serve(parent, crd, sup)
+		if !errors.Is(err, supervisor.ErrRestart) {
+			return err
+		}
+
+		slog.Warn("优雅关闭完毕，重启进程", "supervisor", sup.Name())
+		exx := sup.Restart()
+		attrs := []any{"supervisor", sup.Name(), "error", exx}
+		// 没有外部守护进程拉起（如：原地替换进程失败）时，由当前进程继续提供服务，升级视为失败。
+		if exx = business.AbortUpgrade("重启进程失败：" + exx.Error()); exx != nil {
+			attrs = append(attrs, "abort_error", exx)
+			slog.Error("重启进程失败，无法继续运行", attrs...)
+			return exx
+		}
+		if parent.Err() != nil {
+			return err
+		}
+		slog.Error("重启进程失败，在当前进程内重新启动服务", attrs...)
+	}
+}
+
+func serve(parent context.Context, crd profile.Reader[config.Config], sup supervisor.Supervisor) error {
+	// 排空完毕、收到终止信号或者需要重启时通过 stop 退出。
+	ctx, stop := context.WithCancelCause(parent)
+	defer stop(nil)
+
+	// 通道与监听服务的生命周期独立于 ctx，ctx 取消后先优雅关闭再取消 svcCtx。
+	svcCtx, svcCancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer svcCancel()
+
 	logOpts := &slog.HandlerOptions{AddSource: true, Level: slog.LevelDebug}
 	logh := logger.NewMultiHandler(logger.NewTint(os.Stdout, logOpts))
 	log := slog.New(logh)
 
+	sigs := newSignalNotifier(stop, log)
+	sigs.listen(ctx)
+
 	hideCfg, err := crd.Read()
 	if err != nil {
 		log.Error("配置加载错误", slog.Any("error", err))
@@ -81,6 +119,12 @@ func Exec(ctx context.Context, crd profile.Reader[config.Config]) error {
 		return err
 	}
 
+	// 刚升级的新版本需要在期限内完成启动，否则回滚到旧版本。
+	upgradeGate := business.NewUpgradeGate(sup, stop, log)
+	if err = upgradeGate.Begin(); errors.Is(err, business.ErrUpgradeRollback) {
+		return context.Cause(ctx) // 已经回滚，返回后由 supervisor 重启进程
+	}
+
 	crond := cronv3.New(log, cron.WithSeconds())
 	crond.Start()
 	defer crond.Stop()
@@ -99,18 +143,25 @@ func Exec(ctx context.Context, crd profile.Reader[config.Config]) error {
 		Addresses:  hideCfg.Addresses,
 		PerTimeout: 10 * time.Second,
 		Logger:     log,
-		Context:    ctx,
+		Context:    svcCtx,
 	}
 	tunCliOpt := clientd.Options{
 		Secret:  hideCfg.Secret,
 		Semver:  hideCfg.Semver,
 		Handler: srvSH,
+		Backoff: clientd.Backoff{
+			Min:    time.Duration(hideCfg.Backoff.Min),
+			Max:    time.Duration(hideCfg.Backoff.Max),
+			Stable: time.Duration(hideCfg.Backoff.Stable),
+		},
 	}
 	if tunCliOpt.Semver == "" {
 		info := banner.SelfInfo()
 		tunCliOpt.Semver = info.Semver
 	}
+	stopDial := context.AfterFunc(ctx, svcCancel) // 首次连接中心端期间收到退出信号则放弃连接
 	mux, authCfg, err := clientd.Open(dialCfg, tunCliOpt)
+	stopDial()
 	if err != nil {
 		return err
 	}
@@ -133,31 +184,21 @@ func Exec(ctx context.Context, crd profile.Reader[config.Config]) error {
 	if err != nil {
 		return err
 	}
-	bcfg := curBroker.Config
-	lc := bcfg.Logger
-
-	logLevel := new(slog.LevelVar)
-	_ = logLevel.UnmarshalText([]byte(lc.Level))
-	logOpts.Level = logLevel
-	logh.Replace()
-	if lc.Console {
-		tint := logger.NewTint(os.Stdout, logOpts)
-		logh.Attach(tint)
-	}
-	if fname := lc.Filename; fname != "" {
-		lumber := &lumberjack.Logger{
-			Filename:   fname,
-			MaxSize:    lc.MaxSize,
-			MaxAge:     lc.MaxAge,
-			MaxBackups: lc.MaxBackups,
-			LocalTime:  lc.LocalTime,
-			Compress:   lc.Compress,
-		}
-		defer lumber.Close()
-
-		lh := slog.NewJSONHandler(lumber, logOpts)
-		logh.Attach(lh)
+	brokerCfg := business.NewBrokerConfig(repoAll, curBroker.ID, log)
+	boot, err := brokerCfg.Load(ctx)
+	if err != nil {
+		log.Error("读取 broker 配置错误", slog.Any("error", err))
+		return err
 	}
+	if err = validateSections(valid, bootSections(boot)...); err != nil {
+		log.Error("broker 配置验证错误", slog.Any("error", err))
+		return err
+	}
+	bcfg := boot.BrokerConfig
+
+	logOut := newLogOutput(logh, logOpts)
+	logOut.apply(bcfg.Logger)
+	defer logOut.Close()
 
 	loadCert := repoAll.Certificate().Enables
 	certPool := tlscert.NewMatch(loadCert, log)
@@ -165,14 +206,37 @@ func Exec(ctx context.Context, crd profile.Reader[config.Config]) error {
 	brokerID := curBroker.ID
 	agentSvc := expservice.NewAgent(repoAll, log)
 	victoriaMetricsSvc := business.NewVictoriaMetrics(repoAll, curBroker, log)
+	pyroscopeSvc := business.NewPyroscope(repoAll, log)
 	_ = agentSvc.Reset(ctx, curBroker.ID)
+	lease := business.NewLease(repoAll, brokerID, 30*time.Second)
+	if err = lease.Renew(ctx); err != nil {
+		log.Error("broker 租约续约错误", slog.Any("error", err))
+		return err
+	}
+
+	outboxDir, outboxSize := boot.Outbox.Dir, boot.Outbox.MaxSize
+	if outboxDir == "" {
+		outboxDir = filepath.Join("resources", "outbox")
+	}
+	if outboxSize <= 0 {
+		outboxSize = 64 << 20
+	}
+	dbOutbox, err := outbox.Open(db, outboxDir, outboxSize, log)
+	if err != nil {
+		log.Error("打开数据库写操作发件箱错误", slog.Any("error", err))
+		return err
+	}
+	defer dbOutbox.Close()
 
 	hub := linkhub.NewHub(muxproto.AgentHost)
+	bandwidth := business.NewBandwidth(repoAll, brokerCfg, hub, mux, log)
+	bandwidth.Apply(ctx, boot.Bandwidth)
 	sysdial := &net.Dialer{Timeout: 30 * time.Second}
 	muxdial := muxproto.NewMUXOpener(mux, muxproto.ServerHost)
 	mixdial := rpclient.NewMixedDialer(muxdial, hub, sysdial)
 	basecli := muxtool.NewClient(mixdial, log)
 	rpcli := rpclient.NewClient(basecli)
+	tunEvents := business.NewTunnelEvents(rpcli, brokerID, 0, log)
 
 	agtSH := ship.Default()
 	agtSH.NotFound = shipx.NotFound
@@ -185,33 +249,55 @@ func Exec(ctx context.Context, crd profile.Reader[config.Config]) error {
 			ID:   brokerID,
 			Name: curBroker.Name,
 		},
-		Handler:   agtSH,
-		Huber:     hub,
-		Logger:    log,
-		Validator: valid.Validate,
-		Timeout:   30 * time.Second,
-		Context:   ctx,
+		ServerHooker:  tunEvents,
+		Handler:       agtSH,
+		Huber:         hub,
+		Logger:        log,
+		Validator:     valid.Validate,
+		Authenticator: newAuthenticator(boot.Auth, repoAll),
+		Limiter:       newAdmission(boot.Admission),
+		Bandwidth:     bandwidth,
+		Leaser:        lease,
+		Outbox:        dbOutbox,
+		Timeout:       30 * time.Second,
+		Takeover:      true,
+		ProbeInterval: time.Duration(boot.Liveness.Interval),
+		ProbeFailures: boot.Liveness.Failures,
+		Context:       svcCtx,
 	}
 	tunAccept := serverd.New(repoAll, tunSrvOpts)
 	exposeAPIs := []shipx.RouteRegister{
 		exprestapi.NewTunnel(tunAccept),
 	}
 
-	srvSystemSvc := srvservice.NewSystem(repoAll, hideCfg, bcfg, log)
+	upgrader := business.NewUpgrader(repoAll, hideCfg, sup, stop, log)
+	tunnel := business.NewTunnel(tunAccept)
+	drainer := business.NewDrainer(repoAll, curBroker, tunAccept, rpcli, stop, log)
+	srvSystemSvc := srvservice.NewSystem(repoAll, hideCfg, brokerCfg, upgrader, drainer, sup, stop, log)
 	serverAPIs := []shipx.RouteRegister{
 		srvrestapi.NewReverse(rpcli),
 		srvrestapi.NewEcho(),
 		srvrestapi.NewSystem(mux, srvSystemSvc),
+		srvrestapi.NewBandwidth(srvservice.NewBandwidth(bandwidth, log)),
+		srvrestapi.NewTunnel(srvservice.NewTunnel(tunnel, tunEvents, log)),
 		shipx.NewHealth(),
 		shipx.NewPprof(),
 	}
+	downloadSched := business.NewDownloadScheduler(newDownloadConfig(boot.Download))
 	var agentAPIs []shipx.RouteRegister
 	{
-		healthSvc := agtservice.NewHealth(repoAll, log)
+		healthSvc := agtservice.NewHealth(repoAll, tunAccept, brokerCfg, log)
 		systemSvc := agtservice.NewSystem(repoAll, log)
+		artifactDir := boot.Artifact.Dir
+		if artifactDir == "" {
+			artifactDir = filepath.Join("resources", "artifact")
+		}
+		artifact := business.NewArtifact(repoAll, artifactDir, boot.Artifact.MaxSize, log)
+		releaseSvc := agtservice.NewRelease(repoAll, artifact, downloadSched, log)
 		agentAPIs = append(agentAPIs,
 			agtrestapi.NewHealth(healthSvc),
-			agtrestapi.NewPyroscope(),
+			agtrestapi.NewPyroscope(pyroscopeSvc),
+			agtrestapi.NewRelease(releaseSvc),
 			agtrestapi.NewSystem(systemSvc),
 			agtrestapi.NewVictoriaMetrics(victoriaMetricsSvc),
 		)
@@ -219,7 +305,7 @@ func Exec(ctx context.Context, crd profile.Reader[config.Config]) error {
 
 	// server RPC 路由注册。
 	{
-		otelMid := middle.NewOtel()
+		otelMid := middle.NewOtel("aegis-server-http")
 		apiRGB := srvSH.Group("/api").Use(otelMid)
 		if err = shipx.RegisterRoutes(apiRGB, serverAPIs); err != nil {
 			return err
@@ -240,56 +326,67 @@ func Exec(ctx context.Context, crd profile.Reader[config.Config]) error {
 
 	// agent RPC 路由注册。
 	{
-		apiRGB := agtSH.Group("/api")
+		otelMid := middle.NewOtel("aegis-agent-http")
+		apiRGB := agtSH.Group("/api").Use(otelMid)
 		if err = shipx.RegisterRoutes(apiRGB, agentAPIs); err != nil {
 			return err
 		}
 	}
 
-	tracer, err := initTracer(ctx)
+	tracer, err := initTracer(ctx, boot.Tracing)
 	if err != nil {
+		log.Error("链路追踪初始化错误", slog.Any("error", err))
 		return err
 	}
-	defer tracer.Shutdown(ctx)
+	defer func() {
+		sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_ = tracer.Shutdown(sctx)
+		scancel()
+	}()
 
 	cronTasks := []cronv3.Tasker{
-		crontab.NewHealth(rpcli),
+		crontab.NewHealth(rpcli, mux),
+		crontab.NewLease(lease),
+		crontab.NewKeepalive(tunAccept, brokerCfg, repoAll, outbox.Unordered(db), time.Duration(boot.Keepalive.Interval)),
 		crontab.NewMetrics(curBroker, victoriaMetricsSvc.PushConfig),
 		crontab.NewNetwork(brokerID, repoAll),
-		crontab.NewTransmit(brokerID, mux, hub, repoAll),
+		crontab.NewOutbox(dbOutbox),
+		crontab.NewTransmit(brokerID, mux, tunAccept, repoAll, outbox.Unordered(db)),
 		crontab.NewTransmitMetrics(curBroker, mux, hub, victoriaMetricsSvc.PushConfig),
+		crontab.NewTunnelEvent(tunEvents, mux),
 	}
 	for _, task := range cronTasks {
 		_ = crond.AddTask(task)
 	}
 
-	listenAddr := bcfg.Server.Addr
-	if listenAddr == "" {
-		listenAddr = ":443"
-	}
-
 	httpTLS := &tls.Config{GetCertificate: certPool.GetCertificate, MinVersion: tls.VersionTLS13}
+	if slices.Contains(boot.Auth.Methods, serverd.AuthMethodCertificate) {
+		// 客户端证书只做认证使用（指纹比对），所以无需校验证书链。
+		httpTLS.ClientAuth = tls.RequestClientCert
+	}
 	quicTLS := &tls.Config{GetCertificate: certPool.GetCertificate, MinVersion: tls.VersionTLS13, NextProtos: []string{"aegis"}}
-	httpSrv := &http.Server{
-		Addr:      listenAddr,
-		Handler:   exposeSH,
-		TLSConfig: httpTLS,
-	}
-
-	var quicsrv quick.Server
-	if true {
-		quicsrv = &quick.QUICx{
-			Addr:   listenAddr,
-			Accept: tunAccept,
-			QUICConfig: &quic.Config{
-				TLSConfig:       quicTLS,
-				KeepAlivePeriod: 10 * time.Second,
-				MaxIdleTimeout:  time.Minute,
-			},
+	newHTTP := func(addr string) *http.Server {
+		return &http.Server{
+			Addr:      addr,
+			Handler:   exposeSH,
+			TLSConfig: httpTLS,
 		}
-	} else {
-		quicsrv = &quick.QUICgo{
-			Addr:      listenAddr,
+	}
+	newQUIC := func(addr string) quick.Server {
+		if true {
+			return &quick.QUICx{
+				Addr:   addr,
+				Accept: tunAccept,
+				QUICConfig: &quic.Config{
+					TLSConfig:       quicTLS,
+					KeepAlivePeriod: 10 * time.Second,
+					MaxIdleTimeout:  time.Minute,
+				},
+			}
+		}
+
+		return &quick.QUICgo{
+			Addr:      addr,
 			Handler:   tunAccept,
 			TLSConfig: quicTLS,
 			QUICConfig: &quicgo.Config{
@@ -299,64 +396,207 @@ func Exec(ctx context.Context, crd profile.Reader[config.Config]) error {
 		}
 	}
 
-	errs := make(chan error, 2)
-	go listenHTTP(errs, httpSrv, log)
-	go listenQUIC(ctx, errs, quicsrv)
+	lis := newListener(svcCtx, newHTTP, newQUIC, log)
+	if err = lis.Bind(bcfg.Server.Addr); err != nil {
+		return err
+	}
+	{
+		// 中心端认证通过、数据库连接成功、服务监听成功，视为启动成功。
+		cctx, ccancel := context.WithTimeout(ctx, 10*time.Second)
+		upgradeGate.Confirm(cctx, repoAll, brokerID)
+		ccancel()
+	}
+
+	// 配置热加载：日志、VictoriaMetrics 缓存、下载调度、通道带宽、监听地址。
+	brokerCfg.OnChange(func(hctx context.Context, old, cur *config.Boot) {
+		logOut.apply(cur.Logger)
+		if err := validateSections(valid, bootSection{"download", cur.Download}); err != nil {
+			log.Warn("broker 配置验证错误，忽略本次修改", "error", err)
+		} else {
+			downloadSched.Update(newDownloadConfig(cur.Download))
+		}
+		if old.Bandwidth != cur.Bandwidth {
+			if err := validateSections(valid, bootSection{"bandwidth", cur.Bandwidth}); err != nil {
+				log.Warn("broker 配置验证错误，忽略本次修改", "error", err)
+			} else {
+				bandwidth.Apply(hctx, cur.Bandwidth)
+			}
+		}
+		victoriaMetricsSvc.Reset()
+		pyroscopeSvc.Reset()
+		if old.Server.Addr != cur.Server.Addr {
+			_ = lis.Bind(cur.Server.Addr)
+		}
+	})
+	go brokerCfg.Watch(ctx)
+
+	// 中心端通道断线期间 broker 继续服务节点，重连成功后立即上报暂存的节点通道事件。
+	mux.OnStateChange(func(st clientd.LinkState) {
+		if !st.Connected() {
+			log.Warn("中心端通道断开，进入降级模式", "state", st)
+			return
+		}
+		log.Info("中心端通道已恢复", "state", st)
+		go func() {
+			fctx, fcancel := context.WithTimeout(svcCtx, time.Minute)
+			defer fcancel()
+			_ = tunEvents.Flush(fctx)
+		}()
+	})
+
+	// SIGTERM 排空后退出，排空期间再次收到则直接退出；SIGHUP 重载配置并轮转日志文件。
+	sigs.setHooks(signalHooks{
+		Terminate: func() {
+			timeout := time.Minute
+			if cur, _ := brokerCfg.Load(ctx); cur != nil && cur.Shutdown.Drain > 0 {
+				timeout = time.Duration(cur.Shutdown.Drain)
+			}
+			if err := drainer.Start(ctx, timeout); err != nil {
+				log.Warn("排空中再次收到终止信号，直接退出", "error", err)
+				stop(ErrTerminated)
+			}
+		},
+		Reload: func() {
+			if _, err := brokerCfg.Reload(ctx); err != nil {
+				log.Error("重载配置出错", "error", err)
+			}
+			if err := logOut.rotate(); err != nil {
+				log.Error("轮转日志文件出错", "error", err)
+			}
+		},
+		Dump: func() { dumpState(mux, tunnel, dbOutbox, log) },
+	})
+
 	select {
-	case err = <-errs:
+	case err = <-lis.Errors():
 	case <-ctx.Done():
+		if cause := context.Cause(ctx); errors.Is(cause, business.ErrDrained) ||
+			errors.Is(cause, ErrTerminated) || errors.Is(cause, supervisor.ErrRestart) {
+			err = cause
+		}
 	}
-	_ = httpSrv.Close()
-	_ = quicsrv.Close()
-	_ = mux.Close()
+	shutdown(brokerCfg, lis, tunAccept, mux, log)
+	lis.Close()
+	svcCancel()
 	{
 		cctx, ccancel := context.WithTimeout(context.Background(), 5*time.Second)
 		_ = agentSvc.Reset(cctx, curBroker.ID)
+		_ = lease.Release(cctx)
 		ccancel()
 	}
 
 	return err
 }
 
-func listenHTTP(errs chan<- error, srv *http.Server, log *slog.Logger) {
-	lc := new(net.ListenConfig)
-	lc.SetMultipathTCP(true)
-	ln, err := lc.Listen(context.Background(), "tcp", srv.Addr)
-	if err != nil {
-		errs <- err
-		return
+// shutdown 优雅关闭：不再接受新的连接，等待节点通道与中心端通道上正在处理的请求完成，
+// 并写入每个节点的连接历史记录。
+//
+// 中心端的请求（反向代理）需要经过节点通道，节点的请求也可能需要经过中心端通道，
+// 所以两边同时关闭，各自等待自己正在处理的请求完成。
+func shutdown(brokerCfg *business.BrokerConfig, lis *listener, tun serverd.Server, mux clientd.Muxer, log *slog.Logger) {
+	grace := 30 * time.Second
+	if boot, _ := brokerCfg.Load(context.Background()); boot != nil && boot.Shutdown.Grace > 0 {
+		grace = time.Duration(boot.Shutdown.Grace)
+	}
+	log.Warn("开始优雅关闭", "grace", grace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	_ = lis.Shutdown(ctx)
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		if err := tun.Shutdown(ctx); err != nil {
+			log.Warn("节点通道未能在期限内优雅关闭", "error", err)
+		}
+	})
+	wg.Go(func() {
+		if err := mux.Shutdown(ctx); err != nil {
+			log.Warn("中心端通道未能在期限内优雅关闭", "error", err)
+		}
+	})
+	wg.Wait()
+	log.Warn("优雅关闭完毕")
+}
+
+// newAuthenticator 根据配置创建节点认证器，未配置认证方式时返回 nil。
+//
+// 注意：客户端证书认证仅对 websocket 通道（smux yamux）生效，quic 通道拿不到客户端证书。
+func newAuthenticator(cfg config.BootAuth, repo repository.All) serverd.Authenticator {
+	auths := make([]serverd.Authenticator, 0, len(cfg.Methods))
+	for _, method := range cfg.Methods {
+		switch method {
+		case serverd.AuthMethodToken:
+			auths = append(auths, serverd.NewTokenAuthenticator(cfg.Tokens))
+		case serverd.AuthMethodSecret:
+			auths = append(auths, serverd.NewSecretAuthenticator(repo))
+		case serverd.AuthMethodCertificate:
+			auths = append(auths, serverd.NewCertificateAuthenticator(repo))
+		}
+	}
+	if len(auths) == 0 {
+		return nil
 	}
-	laddr := ln.Addr().String()
-	log.Warn("http 服务监听成功", "listen", laddr)
 
-	errs <- srv.ServeTLS(ln, "", "")
+	return serverd.NewChainAuthenticator(auths...)
 }
 
-func listenQUIC(ctx context.Context, errs chan<- error, srv quick.Server) {
-	errs <- srv.ListenAndServe(ctx)
+// newAdmission 根据配置创建上线准入控制器，未配置任何限制时返回 nil。
+func newAdmission(cfg config.BootAdmission) serverd.Limiter {
+	if cfg.Rate <= 0 && cfg.MaxHandshakes <= 0 {
+		return nil
+	}
+
+	return serverd.NewAdmission(serverd.AdmissionConfig{
+		Rate:          cfg.Rate,
+		Burst:         cfg.Burst,
+		IPv4Prefix:    cfg.IPv4Prefix,
+		IPv6Prefix:    cfg.IPv6Prefix,
+		MaxHandshakes: cfg.MaxHandshakes,
+		RetryAfter:    time.Duration(cfg.RetryAfter),
+	})
 }
 
-func initTracer(ctx context.Context) (*sdktrace.TracerProvider, error) {
-	exp, err := otlptracehttp.New(
-		ctx,
-		otlptracehttp.WithEndpoint("tempo.example.com"),
-		otlptracehttp.WithHeaders(map[string]string{
-			"X-Scope-OrgID": "aegis",
-		}),
-	)
-	if err != nil {
-		return nil, err
+// newDownloadConfig 升级包下载调度配置，带宽单位由 KiB/s 转为字节/秒。
+func newDownloadConfig(cfg config.BootDownload) business.DownloadConfig {
+	return business.DownloadConfig{
+		Rate:         cfg.Rate * 1024,
+		Concurrent:   cfg.Concurrent,
+		Queue:        cfg.Queue,
+		QueueTimeout: time.Duration(cfg.QueueTimeout),
 	}
+}
 
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exp),
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceName("aegis-broker"),
-		)),
-	)
+// bootSection broker 配置中的一节，name 与 json 字段名一致。
+type bootSection struct {
+	name  string
+	value any
+}
+
+// bootSections broker 配置中启动时需要验证的各节。
+func bootSections(boot *config.Boot) []bootSection {
+	return []bootSection{
+		{"auth", boot.Auth},
+		{"admission", boot.Admission},
+		{"tracing", boot.Tracing},
+		{"artifact", boot.Artifact},
+		{"download", boot.Download},
+		{"bandwidth", boot.Bandwidth},
+		{"shutdown", boot.Shutdown},
+		{"keepalive", boot.Keepalive},
+		{"liveness", boot.Liveness},
+		{"outbox", boot.Outbox},
+	}
+}
+
+// validateSections 依次验证各节配置，返回的错误带有出错的节名。
+func validateSections(valid *validation.Validate, sections ...bootSection) error {
+	for _, sec := range sections {
+		if err := valid.Validate(sec.value); err != nil {
+			return fmt.Errorf("%s: %w", sec.name, err)
+		}
+	}
 
-	otel.SetTracerProvider(tp)
-	otel.SetTextMapPropagator(propagation.TraceContext{})
-	return tp, nil
+	return nil
 }
@@ -0,0 +1,63 @@
+package launch
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+)
+
+// ErrTerminated 收到终止信号（SIGTERM），作为进程退出的原因。
+var ErrTerminated = errors.New("收到终止信号")
+
+// signalHooks 进程信号的处理函数，为空时使用默认的处理方式。
+type signalHooks struct {
+	Terminate func() // SIGTERM，默认直接退出。
+	Reload    func() // SIGHUP，默认忽略。
+	Dump      func() // SIGUSR1，默认忽略。
+}
+
+// signalNotifier 进程信号处理。
+//
+// 启动时就开始监听信号，但是排空、重载配置等依赖的服务要等启动完毕才有，
+// 所以启动完毕前收到 SIGTERM 直接退出，其它信号忽略。
+type signalNotifier struct {
+	hooks atomic.Pointer[signalHooks]
+	stop  context.CancelCauseFunc
+	log   *slog.Logger
+}
+
+func newSignalNotifier(stop context.CancelCauseFunc, log *slog.Logger) *signalNotifier {
+	return &signalNotifier{
+		stop: stop,
+		log:  log,
+	}
+}
+
+func (sn *signalNotifier) setHooks(hooks signalHooks) {
+	sn.hooks.Store(&hooks)
+}
+
+func (sn *signalNotifier) terminate() {
+	if h := sn.hooks.Load(); h != nil && h.Terminate != nil {
+		h.Terminate()
+		return
+	}
+	sn.stop(ErrTerminated)
+}
+
+func (sn *signalNotifier) reload() {
+	if h := sn.hooks.Load(); h != nil && h.Reload != nil {
+		h.Reload()
+		return
+	}
+	sn.log.Warn("服务尚未启动完毕，忽略重载信号")
+}
+
+func (sn *signalNotifier) dump() {
+	if h := sn.hooks.Load(); h != nil && h.Dump != nil {
+		h.Dump()
+		return
+	}
+	sn.log.Warn("服务尚未启动完毕，忽略状态导出信号")
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package launch
+
+import "context"
+
+// listen 非 unix 系统没有 SIGTERM SIGHUP SIGUSR1，不做处理。
+func (sn *signalNotifier) listen(context.Context) {}
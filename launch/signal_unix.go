@@ -0,0 +1,37 @@
+//go:build unix
+
+package launch
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// listen 监听 SIGTERM（排空后退出）、SIGHUP（重载配置并轮转日志文件）、
+// SIGUSR1（导出协程与通道状态到日志），直至 ctx 取消。
+func (sn *signalNotifier) listen(ctx context.Context) {
+	ch := make(chan os.Signal, 4)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-ch:
+				sn.log.Warn("收到进程信号", "signal", sig)
+				switch sig {
+				case syscall.SIGTERM:
+					sn.terminate()
+				case syscall.SIGHUP:
+					sn.reload()
+				case syscall.SIGUSR1:
+					sn.dump()
+				}
+			}
+		}
+	}()
+}
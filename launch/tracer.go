@@ -0,0 +1,99 @@
+package launch
+
+import (
+	"context"
+	"strings"
+
+	"github.com/xmx/aegis-broker/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.38.0"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+type tracerShutdown interface {
+	Shutdown(ctx context.Context) error
+}
+
+type noopShutdown struct{}
+
+func (noopShutdown) Shutdown(context.Context) error { return nil }
+
+// initTracer 初始化链路追踪，未配置上报地址时为 no-op 模式：
+// 不产生 span，但仍然透传上下游的 trace 上下文。
+func initTracer(ctx context.Context, cfg config.BootTracing) (tracerShutdown, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if cfg.Endpoint == "" {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		return noopShutdown{}, nil
+	}
+
+	exp, err := newTraceExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if ratio := cfg.SampleRatio; ratio != nil && *ratio < 1 {
+		// TraceIDRatioBased 在 ratio <= 0 时就是 NeverSample。
+		sampler = sdktrace.TraceIDRatioBased(*ratio)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName("aegis-broker"),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp, nil
+}
+
+func newTraceExporter(ctx context.Context, cfg config.BootTracing) (sdktrace.SpanExporter, error) {
+	// 带有 scheme 的视为完整的 URL，否则视为 host:port。
+	endpoint := cfg.Endpoint
+	isURL := strings.Contains(endpoint, "://")
+
+	if cfg.Protocol == "grpc" {
+		var opts []otlptracegrpc.Option
+		if isURL {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(endpoint))
+		} else {
+			opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		if len(cfg.Headers) != 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(cfg.Headers))
+		}
+
+		return otlptracegrpc.New(ctx, opts...)
+	}
+
+	var opts []otlptracehttp.Option
+	if isURL {
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	} else {
+		opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(cfg.Headers) != 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+
+	return otlptracehttp.New(ctx, opts...)
+}
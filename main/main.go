@@ -29,6 +29,7 @@ func main() {
 		}
 	}
 
+	// Ctrl+C 直接优雅关闭；SIGTERM（排空后退出）、SIGHUP（重载配置）、SIGUSR1（导出状态）由 launch 处理。
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
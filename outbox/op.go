@@ -0,0 +1,149 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/topology"
+)
+
+// 写操作类型。
+const (
+	KindInsertOne = "insert_one"
+	KindUpdateOne = "update_one"
+)
+
+// Op 一次数据库写操作。
+//
+// 写操作可能会被重放多次，所以要求写操作是幂等的：插入的文档要事先指定 _id，
+// 修改操作使用 $set 并且在 filter 中带上能区分新旧状态的条件（如：session_id）。
+type Op struct {
+	Collection string    `bson:"collection"`
+	Kind       string    `bson:"kind"`
+	Filter     any       `bson:"filter,omitempty"`
+	Update     any       `bson:"update,omitempty"`
+	Document   any       `bson:"document,omitempty"`
+	CreatedAt  time.Time `bson:"created_at"`
+}
+
+// InsertOne 插入一条文档，doc 必须指定了 _id，否则重放时会重复插入。
+func InsertOne(coll string, doc any) Op {
+	return Op{Collection: coll, Kind: KindInsertOne, Document: doc, CreatedAt: time.Now()}
+}
+
+// UpdateOne 修改一条文档。
+func UpdateOne(coll string, filter, update any) Op {
+	return Op{Collection: coll, Kind: KindUpdateOne, Filter: filter, Update: update, CreatedAt: time.Now()}
+}
+
+func (op Op) writeModel() mongo.WriteModel {
+	if op.Kind == KindInsertOne {
+		return mongo.NewInsertOneModel().SetDocument(op.Document)
+	}
+
+	return mongo.NewUpdateOneModel().SetFilter(op.Filter).SetUpdate(op.Update)
+}
+
+// Writer 数据库写入器。
+type Writer interface {
+	// Write 按顺序执行写操作。
+	Write(ctx context.Context, ops ...Op) error
+}
+
+// Direct 直接写入数据库，出错不暂存。
+func Direct(db *mongo.Database) Writer {
+	return directWriter{db: db}
+}
+
+type directWriter struct {
+	db *mongo.Database
+}
+
+func (dw directWriter) Write(ctx context.Context, ops ...Op) error {
+	_, err := execute(ctx, dw.db, ops)
+	return err
+}
+
+// Unordered 直接写入数据库，同一个集合的写操作合并为一次无序的批量写入，出错不暂存。
+//
+// 无序批量写入中某个写操作出错不影响其它写操作，适用于互不依赖的幂等写操作，
+// 如：按 _id 批量 $set 节点的心跳时间、传输字节数。
+func Unordered(db *mongo.Database) Writer {
+	return unorderedWriter{db: db}
+}
+
+type unorderedWriter struct {
+	db *mongo.Database
+}
+
+func (uw unorderedWriter) Write(ctx context.Context, ops ...Op) error {
+	groups := make(map[string][]mongo.WriteModel, 2)
+	for _, op := range ops {
+		groups[op.Collection] = append(groups[op.Collection], op.writeModel())
+	}
+
+	var errs []error
+	opt := options.BulkWrite().SetOrdered(false)
+	for coll, mods := range groups {
+		if _, err := uw.db.Collection(coll).BulkWrite(ctx, mods, opt); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// execute 按顺序执行写操作，相邻且集合相同的写操作合并为一次有序的批量写入。
+//
+// 返回已经执行完毕的写操作个数，遇到不可重试的错误时，最后一个就是出错的写操作。
+func execute(ctx context.Context, db *mongo.Database, ops []Op) (int, error) {
+	opt := options.BulkWrite().SetOrdered(true)
+	var done int
+	for done < len(ops) {
+		coll := ops[done].Collection
+		end := done + 1
+		for end < len(ops) && ops[end].Collection == coll {
+			end++
+		}
+
+		mods := make([]mongo.WriteModel, 0, end-done)
+		for _, op := range ops[done:end] {
+			mods = append(mods, op.writeModel())
+		}
+		if _, err := db.Collection(coll).BulkWrite(ctx, mods, opt); err != nil {
+			if retryable(err) {
+				return done, err
+			}
+
+			// 有序批量写入遇到第一个错误就停止，出错之前的写操作均已执行，出错的写操作也计入 done。
+			// 无法确定是哪个写操作出错时，视为第一个写操作出错。
+			var bwe mongo.BulkWriteException
+			if errors.As(err, &bwe) && len(bwe.WriteErrors) != 0 {
+				done += bwe.WriteErrors[0].Index + 1
+			} else {
+				done++
+			}
+			return done, err
+		}
+		done = end
+	}
+
+	return done, nil
+}
+
+// retryable 是否是数据库不可用导致的错误，这类错误稍后重试可能成功。
+func retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) ||
+		errors.Is(err, mongo.ErrClientDisconnected) {
+		return true
+	}
+	var sse topology.ServerSelectionError
+
+	return errors.As(err, &sse)
+}
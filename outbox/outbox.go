@@ -0,0 +1,371 @@
+// Package outbox 数据库写操作的本地发件箱。
+//
+// 数据库不可用时，写操作按顺序追加到本地文件中，等数据库恢复后再按顺序重放，
+// 避免数据库短暂故障导致节点在线状态、连接历史记录等数据丢失或不一致。
+package outbox
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xmx/metrics"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// ErrFull 发件箱已满，写操作被丢弃。
+var ErrFull = errors.New("数据库写操作发件箱已满")
+
+// Stat 发件箱状态。
+type Stat struct {
+	Pending  int64  `json:"pending"`  // 等待重放的写操作数
+	Size     int64  `json:"size"`     // 数据文件大小（字节）
+	MaxSize  int64  `json:"max_size"` // 数据文件大小上限（字节）
+	Queued   uint64 `json:"queued"`   // 累计暂存的写操作数
+	Replayed uint64 `json:"replayed"` // 累计重放成功的写操作数
+	Failed   uint64 `json:"failed"`   // 累计重放失败（不可重试）被跳过的写操作数
+	Dropped  uint64 `json:"dropped"`  // 累计因发件箱已满被丢弃的写操作数
+}
+
+// Open 打开 dir 目录下的发件箱，maxSize 为数据文件大小上限（字节）。
+//
+// 上次退出时没有重放完毕的写操作会保留下来，由 Replay 继续重放。
+func Open(db *mongo.Database, dir string, maxSize int64, log *slog.Logger) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	ob := &Outbox{
+		exec: func(ctx context.Context, ops []Op) (int, error) {
+			return execute(ctx, db, ops)
+		},
+		name:     filepath.Join(dir, "outbox.dat"),
+		posName:  filepath.Join(dir, "outbox.pos"),
+		maxSize:  maxSize,
+		log:      log,
+		queued:   metrics.GetOrCreateCounter("aegis_broker_outbox_queued_total"),
+		replayed: metrics.GetOrCreateCounter("aegis_broker_outbox_replayed_total"),
+		failed:   metrics.GetOrCreateCounter("aegis_broker_outbox_failed_total"),
+		dropped:  metrics.GetOrCreateCounter("aegis_broker_outbox_dropped_total"),
+	}
+	if err := ob.load(); err != nil {
+		return nil, err
+	}
+	metrics.GetOrCreateGauge("aegis_broker_outbox_pending", func() float64 {
+		return float64(ob.Stat().Pending)
+	})
+	metrics.GetOrCreateGauge("aegis_broker_outbox_size_bytes", func() float64 {
+		return float64(ob.Stat().Size)
+	})
+	if ob.pending != 0 {
+		log.Warn("发件箱中有未重放的数据库写操作", "pending", ob.pending, "size", ob.size)
+	}
+
+	return ob, nil
+}
+
+// Outbox 数据库写操作发件箱。
+//
+// 数据文件由连续的 BSON 文档组成，每个文档就是一个 Op，重放位置单独保存在 outbox.pos 中。
+// 全部重放完毕后清空数据文件。
+type Outbox struct {
+	name     string // 数据文件
+	posName  string // 重放位置文件
+	maxSize  int64
+	log      *slog.Logger
+	writeMu  sync.Mutex // Write 判断是否有未重放的写操作、直接写入、追加到发件箱三步必须是原子的
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64 // 数据文件大小
+	head     int64 // 重放位置，之前的写操作已经重放完毕
+	pending  int64 // 等待重放的写操作数
+	replayMu sync.Mutex
+
+	exec func(ctx context.Context, ops []Op) (int, error) // 按顺序执行写操作，见 execute
+
+	queued   *metrics.Counter
+	replayed *metrics.Counter
+	failed   *metrics.Counter
+	dropped  *metrics.Counter
+}
+
+// Write 按顺序执行写操作，数据库不可用时暂存到发件箱，暂存成功也视为写入成功。
+//
+// 发件箱中还有未重放的写操作时，新的写操作直接追加到发件箱，保证写入顺序。
+// 遇到不可重试的错误（如：重复插入）时跳过出错的写操作，继续执行后面的写操作，返回的错误包含所有被跳过的写操作的错误。
+// 并发调用按顺序逐个执行，避免前一个写操作暂存到发件箱的同时，后一个写操作越过它直接写入数据库。
+func (ob *Outbox) Write(ctx context.Context, ops ...Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	ob.writeMu.Lock()
+	defer ob.writeMu.Unlock()
+
+	ob.mutex.Lock()
+	pending := ob.pending
+	ob.mutex.Unlock()
+	if pending != 0 {
+		return ob.append(ops)
+	}
+
+	// 与 Replay 一致：不可重试的错误只跳过出错的写操作，继续执行后面的写操作。
+	var errs []error
+	for len(ops) != 0 {
+		done, err := ob.exec(ctx, ops)
+		if err == nil {
+			break
+		}
+		if retryable(err) {
+			ob.log.Warn("数据库不可用，写操作暂存到发件箱", "count", len(ops)-done, "error", err)
+			if exx := ob.append(ops[done:]); exx != nil {
+				errs = append(errs, exx)
+			}
+			break
+		}
+
+		op := ops[done-1]
+		ob.log.Error("数据库写操作失败，跳过该写操作", "collection", op.Collection, "kind", op.Kind, "error", err)
+		errs = append(errs, err)
+		ops = ops[done:]
+	}
+
+	return errors.Join(errs...)
+}
+
+// Replay 按顺序重放发件箱中的写操作，直到全部重放完毕或者数据库不可用。
+func (ob *Outbox) Replay(ctx context.Context) error {
+	const batch = 100
+
+	ob.replayMu.Lock()
+	defer ob.replayMu.Unlock()
+
+	for {
+		ops, offsets, err := ob.read(batch)
+		if err != nil || len(ops) == 0 {
+			return err
+		}
+
+		done, err := ob.exec(ctx, ops)
+		if retryable(err) {
+			ob.advance(offsets, done, 0)
+			return err
+		}
+		var skip int
+		if err != nil {
+			// 不可重试的错误（如：重复插入）重放多少次都一样，跳过出错的写操作。
+			skip = 1
+			op := ops[done-1]
+			ob.log.Error("重放数据库写操作失败，跳过该写操作", "collection", op.Collection, "kind", op.Kind, "error", err)
+		}
+		ob.advance(offsets, done, skip)
+	}
+}
+
+// Stat 发件箱状态。
+func (ob *Outbox) Stat() Stat {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	return Stat{
+		Pending:  ob.pending,
+		Size:     ob.size,
+		MaxSize:  ob.maxSize,
+		Queued:   ob.queued.Get(),
+		Replayed: ob.replayed.Get(),
+		Failed:   ob.failed.Get(),
+		Dropped:  ob.dropped.Get(),
+	}
+}
+
+// Close 关闭发件箱，未重放的写操作保留在文件中，下次启动时继续重放。
+func (ob *Outbox) Close() error {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	return ob.file.Close()
+}
+
+// append 将写操作追加到数据文件末尾。
+func (ob *Outbox) append(ops []Op) error {
+	buf := make([]byte, 0, 512*len(ops))
+	for _, op := range ops {
+		raw, err := bson.Marshal(op)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, raw...)
+	}
+
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	if ob.maxSize > 0 && ob.size+int64(len(buf)) > ob.maxSize {
+		ob.dropped.Add(len(ops))
+		ob.log.Error("发件箱已满，丢弃数据库写操作", "count", len(ops), "size", ob.size, "max_size", ob.maxSize)
+		return ErrFull
+	}
+	if _, err := ob.file.Write(buf); err != nil {
+		// 写入了一半的数据在下次启动时会被截断。
+		return err
+	}
+	// 暂存成功就视为写入成功，必须落盘后才能返回。
+	if err := ob.file.Sync(); err != nil {
+		return err
+	}
+	ob.size += int64(len(buf))
+	ob.pending += int64(len(ops))
+	ob.queued.Add(len(ops))
+
+	return nil
+}
+
+// read 从重放位置开始读取最多 limit 个写操作，offsets 为每个写操作结束时的文件偏移。
+func (ob *Outbox) read(limit int) ([]Op, []int64, error) {
+	ob.mutex.Lock()
+	head, size := ob.head, ob.size
+	ob.mutex.Unlock()
+
+	var ops []Op
+	var offsets []int64
+	for head < size && len(ops) < limit {
+		raw, err := readDocument(ob.file, head)
+		if err != nil {
+			return nil, nil, err
+		}
+		var op Op
+		if err = bson.Unmarshal(raw, &op); err != nil {
+			return nil, nil, err
+		}
+		head += int64(len(raw))
+		ops = append(ops, op)
+		offsets = append(offsets, head)
+	}
+
+	return ops, offsets, nil
+}
+
+// advance 前 done 个写操作执行完毕，其中最后 skip 个执行失败被跳过，向后移动重放位置。
+func (ob *Outbox) advance(offsets []int64, done, skip int) {
+	if done == 0 {
+		return
+	}
+
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	ob.head = offsets[done-1]
+	ob.pending -= int64(done)
+	ob.replayed.Add(done - skip)
+	ob.failed.Add(skip)
+
+	if ob.pending == 0 && ob.head == ob.size {
+		// 全部重放完毕，清空数据文件。
+		if err := ob.file.Truncate(0); err == nil {
+			ob.head, ob.size = 0, 0
+		}
+		ob.log.Info("发件箱中的数据库写操作全部重放完毕")
+	}
+	if err := ob.savePos(); err != nil {
+		ob.log.Warn("保存发件箱重放位置出错", "error", err)
+	}
+}
+
+// load 打开数据文件并恢复重放位置，截断末尾不完整的写操作（写入时进程退出）。
+func (ob *Outbox) load() error {
+	file, err := os.OpenFile(ob.name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	var head int64
+	if raw, _ := os.ReadFile(ob.posName); len(raw) != 0 {
+		head, _ = strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+	}
+	size := info.Size()
+	if head < 0 || head > size {
+		head = 0
+	}
+
+	var pending int64
+	offset := head
+	for offset < size {
+		raw, exx := readDocument(file, offset)
+		if exx != nil {
+			ob.log.Warn("发件箱数据文件末尾不完整，截断", "offset", offset, "size", size, "error", exx)
+			if err = file.Truncate(offset); err != nil {
+				_ = file.Close()
+				return err
+			}
+			size = offset
+			break
+		}
+		offset += int64(len(raw))
+		pending++
+	}
+
+	ob.file = file
+	ob.size = size
+	ob.head = head
+	ob.pending = pending
+
+	return nil
+}
+
+// savePos 先写临时文件并落盘，再重命名覆盖，避免断电后重放位置文件为空或者不完整。
+func (ob *Outbox) savePos() error {
+	tmp := ob.posName + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteString(strconv.FormatInt(ob.head, 10)); err == nil {
+		err = file.Sync()
+	}
+	if exx := file.Close(); err == nil {
+		err = exx
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, ob.posName)
+}
+
+// readDocument 读取 offset 处的一个 BSON 文档。
+func readDocument(r io.ReaderAt, offset int64) (bson.Raw, error) {
+	var hdr [4]byte
+	if _, err := r.ReadAt(hdr[:], offset); err != nil {
+		return nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(hdr[:]))
+	if size < 5 {
+		return nil, fmt.Errorf("BSON 文档长度错误：%d", size)
+	}
+
+	raw := make([]byte, size)
+	if _, err := r.ReadAt(raw, offset); err != nil {
+		return nil, err
+	}
+	doc := bson.Raw(raw)
+	if err := doc.Validate(); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
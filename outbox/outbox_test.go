@@ -0,0 +1,193 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// unavailable 模拟数据库不可用，所有写操作都暂存到发件箱。
+func unavailable(context.Context, []Op) (int, error) {
+	return 0, mongo.ErrClientDisconnected
+}
+
+func openOutbox(t *testing.T, dir string) *Outbox {
+	t.Helper()
+
+	ob, err := Open(nil, dir, 0, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob.exec = unavailable
+	t.Cleanup(func() { _ = ob.Close() })
+
+	return ob
+}
+
+func testOps(names ...string) []Op {
+	ops := make([]Op, 0, len(names))
+	for _, name := range names {
+		ops = append(ops, InsertOne(name, bson.M{"_id": name}))
+	}
+
+	return ops
+}
+
+func collections(ops []Op) []string {
+	names := make([]string, 0, len(ops))
+	for _, op := range ops {
+		names = append(names, op.Collection)
+	}
+
+	return names
+}
+
+func TestLoadTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	ob := openOutbox(t, dir)
+	if err := ob.Write(t.Context(), testOps("a", "b")...); err != nil {
+		t.Fatal(err)
+	}
+	size := ob.Stat().Size
+	_ = ob.Close()
+
+	// 模拟写入一半时进程退出：追加一个不完整的文档。
+	raw, err := bson.Marshal(testOps("c")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(ob.name, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write(raw[:len(raw)/2]); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	ob = openOutbox(t, dir)
+	stat := ob.Stat()
+	if stat.Pending != 2 || stat.Size != size {
+		t.Fatalf("pending = %d, size = %d, want pending = 2, size = %d", stat.Pending, stat.Size, size)
+	}
+	info, err := os.Stat(ob.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != size {
+		t.Fatalf("file size = %d, want %d", info.Size(), size)
+	}
+}
+
+func TestLoadRecoversPosition(t *testing.T) {
+	dir := t.TempDir()
+	ob := openOutbox(t, dir)
+	if err := ob.Write(t.Context(), testOps("a", "b", "c")...); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重放完第一个写操作后数据库再次不可用。
+	ob.exec = func(context.Context, []Op) (int, error) {
+		return 1, mongo.ErrClientDisconnected
+	}
+	if err := ob.Replay(t.Context()); !retryable(err) {
+		t.Fatalf("replay error = %v, want retryable", err)
+	}
+	_ = ob.Close()
+
+	ob = openOutbox(t, dir)
+	if pending := ob.Stat().Pending; pending != 2 {
+		t.Fatalf("pending = %d, want 2", pending)
+	}
+
+	var replayed []string
+	ob.exec = func(_ context.Context, ops []Op) (int, error) {
+		replayed = append(replayed, collections(ops)...)
+		return len(ops), nil
+	}
+	if err := ob.Replay(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 2 || replayed[0] != "b" || replayed[1] != "c" {
+		t.Fatalf("replayed = %v, want [b c]", replayed)
+	}
+	if stat := ob.Stat(); stat.Pending != 0 || stat.Size != 0 {
+		t.Fatalf("pending = %d, size = %d, want empty", stat.Pending, stat.Size)
+	}
+}
+
+func TestReplaySkipsNonRetryable(t *testing.T) {
+	ob := openOutbox(t, t.TempDir())
+	if err := ob.Write(t.Context(), testOps("a", "b", "c")...); err != nil {
+		t.Fatal(err)
+	}
+
+	// 第二个写操作不可重试（如：重复插入），跳过后继续重放后面的写操作。
+	var replayed []string
+	ob.exec = func(_ context.Context, ops []Op) (int, error) {
+		for i, op := range ops {
+			if op.Collection == "b" {
+				return i + 1, errors.New("duplicate key")
+			}
+			replayed = append(replayed, op.Collection)
+		}
+		return len(ops), nil
+	}
+
+	failed, done := ob.failed.Get(), ob.replayed.Get()
+	if err := ob.Replay(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 2 || replayed[0] != "a" || replayed[1] != "c" {
+		t.Fatalf("replayed = %v, want [a c]", replayed)
+	}
+	if n := ob.failed.Get() - failed; n != 1 {
+		t.Fatalf("failed = %d, want 1", n)
+	}
+	if n := ob.replayed.Get() - done; n != 2 {
+		t.Fatalf("replayed = %d, want 2", n)
+	}
+	if pending := ob.Stat().Pending; pending != 0 {
+		t.Fatalf("pending = %d, want 0", pending)
+	}
+}
+
+func TestWriteSkipsNonRetryable(t *testing.T) {
+	ob := openOutbox(t, t.TempDir())
+
+	// 第二个写操作不可重试，跳过后继续执行；第四个写操作遇到数据库不可用，暂存到发件箱。
+	var written []string
+	ob.exec = func(_ context.Context, ops []Op) (int, error) {
+		for i, op := range ops {
+			switch op.Collection {
+			case "b":
+				return i + 1, errors.New("duplicate key")
+			case "d":
+				return i, mongo.ErrClientDisconnected
+			}
+			written = append(written, op.Collection)
+		}
+		return len(ops), nil
+	}
+
+	err := ob.Write(t.Context(), testOps("a", "b", "c", "d")...)
+	if err == nil || retryable(err) {
+		t.Fatalf("write error = %v, want non-retryable", err)
+	}
+	if len(written) != 2 || written[0] != "a" || written[1] != "c" {
+		t.Fatalf("written = %v, want [a c]", written)
+	}
+
+	ops, _, err := ob.read(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := collections(ops); len(got) != 1 || got[0] != "d" {
+		t.Fatalf("queued = %v, want [d]", got)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package supervisor
+
+import "errors"
+
+var errExecUnsupported = errors.New("当前系统不支持原地替换进程")
+
+func execve(string, []string, []string) error {
+	return errExecUnsupported
+}
+
+func executable(string) error {
+	return errExecUnsupported
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package supervisor
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func execve(argv0 string, argv, envv []string) error {
+	return syscall.Exec(argv0, argv, envv)
+}
+
+// executable 检查文件能否被 execve 执行。
+func executable(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0o111 == 0 {
+		return errors.New("不是可执行文件：" + name)
+	}
+
+	return nil
+}
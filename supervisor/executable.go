@@ -0,0 +1,26 @@
+package supervisor
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// LinkName 程序的入口文件名，指向当前版本的可执行文件（符号链接）。
+const LinkName = "aegis-broker"
+
+// Executable 程序的入口文件路径。
+//
+// 升级时新版本以版本号命名落地在同一目录下，入口文件 aegis-broker 以符号链接的方式指向它，
+// 重启时应当执行入口文件才能启动新版本。
+func Executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(exe)
+
+	return filepath.Join(dir, LinkName), nil
+}
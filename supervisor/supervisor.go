@@ -0,0 +1,110 @@
+// Package supervisor 进程守护抽象，用于升级、回滚后重启 broker。
+package supervisor
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrRestart 需要重启进程，作为进程退出的原因。
+//
+// 升级、回滚、重启指令不能直接退出进程，而是以此为原因取消根 context，
+// 等优雅关闭（节点下线处理、释放租约、关闭发件箱等）完毕后再调用 Supervisor.Restart。
+var ErrRestart = errors.New("等待 supervisor 重启")
+
+// Supervisor 进程的守护方式。
+type Supervisor interface {
+	// Name 守护方式的名字，例如：systemd exec。
+	Name() string
+
+	// Check 检查能否重启当前进程，在开始优雅关闭之前调用，不能重启时不应退出。
+	Check() error
+
+	// Restart 重启当前进程，必须在优雅关闭完毕之后调用，重启成功时不会返回。
+	Restart() error
+}
+
+// exitTempFail 退出码并不重要，较真的话可以选择一个有意义的 code。
+// https://man.openbsd.org/sysexits.3#EX_TEMPFAIL
+const exitTempFail = 75
+
+// Detect 探测当前进程的守护方式。
+//
+// 由 systemd 启动（存在 INVOCATION_ID 环境变量）时通过退出进程交由 systemd 重新拉起，
+// 否则在原地用新的可执行文件替换当前进程（Windows 不支持）。
+func Detect(unit string) Supervisor {
+	if os.Getenv("INVOCATION_ID") != "" {
+		return NewSystemd(unit)
+	}
+
+	return NewExec()
+}
+
+// NewSystemd systemd 守护，要求 unit 配置了 Restart=always 或 Restart=on-failure。
+func NewSystemd(unit string) Supervisor {
+	return &systemd{unit: unit}
+}
+
+type systemd struct {
+	unit string
+}
+
+func (s *systemd) Name() string { return "systemd" }
+
+func (s *systemd) Check() error {
+	// 检查服务文件是否存在，如果不存在就不能退出，会导致服务无法启动。
+	dirs := []string{"/etc/systemd/system/", "/usr/lib/systemd/system/", "/lib/systemd/system/"}
+	var err error
+	for _, dir := range dirs {
+		if _, err = os.Stat(dir + s.unit); err == nil {
+			break
+		}
+	}
+
+	return err
+}
+
+func (s *systemd) Restart() error {
+	os.Exit(exitTempFail)
+	return nil
+}
+
+// NewExec 原地替换进程，不依赖外部守护。
+func NewExec() Supervisor {
+	return new(execSupervisor)
+}
+
+type execSupervisor struct{}
+
+func (*execSupervisor) Name() string { return "exec" }
+
+func (e *execSupervisor) Check() error {
+	exe, err := e.executable()
+	if err != nil {
+		return err
+	}
+
+	return executable(exe)
+}
+
+func (e *execSupervisor) Restart() error {
+	exe, err := e.executable()
+	if err != nil {
+		return err
+	}
+
+	return execve(exe, os.Args, os.Environ())
+}
+
+// executable 重启时执行的程序：入口文件，没有升级过（入口文件不存在）时就是当前程序。
+func (*execSupervisor) executable() (string, error) {
+	exe, err := Executable()
+	if err != nil {
+		return "", err
+	}
+	if _, err = os.Stat(exe); err != nil {
+		return os.Executable()
+	}
+
+	return exe, nil
+}